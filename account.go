@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/mailer"
+	"hacknhbackend.eparker.dev/util"
+)
+
+func registerAccountRoutes() {
+	// Change password, requires the current one
+	http.HandleFunc("/user/password/change", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		obj := struct {
+			Current  string `json:"current"`
+			Password string `json:"password"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !user.CheckPassword(obj.Current) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if !database.ValidPassword(obj.Password) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := user.SetPassword(obj.Password); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Log out every other session and keep this one going with a new token
+		database.RevokeOneTimeTokens(user.ID, database.TOKEN_PURPOSE_PASSWORD_RESET)
+		RevokeTokens(user.Email)
+		setSessionCookies(w, user.Email)
+
+		w.WriteHeader(http.StatusOK)
+
+		mailer.SendAsync(mailer.Message{
+			To:      user.Email,
+			Subject: "Your password was changed",
+			Body:    fmt.Sprintf("Hi %s,\n\nThe password for your account was just changed. If this wasn't you, reset it right away.\n", user.FirstName),
+		})
+
+		util.Log.Basic(fmt.Sprintf("User %s changed their password", user.Email))
+	})
+
+	// Change email, requires the password and verifying the new address
+	http.HandleFunc("/user/email/change", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		obj := struct {
+			Password string `json:"password"`
+			Email    string `json:"email"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		newEmail := strings.ToLower(obj.Email)
+
+		if !database.ValidEmail(newEmail) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !user.CheckPassword(obj.Password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if _, err := database.GetUser(newEmail); err == nil {
+			w.WriteHeader(http.StatusIMUsed)
+			return
+		}
+
+		oldEmail := user.Email
+
+		if err := user.ChangeEmail(newEmail); err == database.ErrorEmailTaken {
+			// Taken between the check above and the write
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Links sent to the old address shouldn't work anymore
+		database.RevokeOneTimeTokens(user.ID, database.TOKEN_PURPOSE_PASSWORD_RESET)
+		RevokeTokens(oldEmail)
+		setSessionCookies(w, user.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(user.JSON())
+
+		sendVerificationEmail(user)
+
+		mailer.SendAsync(mailer.Message{
+			To:      oldEmail,
+			Subject: "Your email address was changed",
+			Body:    fmt.Sprintf("Hi %s,\n\nThe email address for your account was just changed to %s. If this wasn't you, contact us right away.\n", user.FirstName, user.Email),
+		})
+
+		util.Log.Basic(fmt.Sprintf("User %s changed their email to %s", oldEmail, user.Email))
+	})
+}
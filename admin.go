@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/util"
+)
+
+// Like withAuth, but the user's role also has to grant the permission
+func withPermission(w http.ResponseWriter, r *http.Request, permission database.Permission) bool {
+	if !withAuth(w, r) {
+		return false
+	}
+
+	email, _ := r.Cookie("email")
+	user, err := database.GetUser(email.Value)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+
+	if !user.Can(permission) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func registerAdminRoutes() {
+	// Every role and what it's allowed to do
+	http.HandleFunc("/admin/roles", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withPermission(w, r, database.PERMISSION_MANAGE_ROLES) {
+			return
+		}
+
+		roles := make(map[string][]database.Permission)
+
+		for role, name := range database.RoleNames {
+			roles[name] = role.Permissions()
+		}
+
+		if jsonRoles, err := json.Marshal(roles); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonRoles)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	http.HandleFunc("/admin/role/grant", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withPermission(w, r, database.PERMISSION_MANAGE_ROLES) {
+			return
+		}
+
+		obj := struct {
+			Email string `json:"email"`
+			Role  string `json:"role"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		role, ok := database.ParseRole(obj.Role)
+
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		changeRole(w, r, strings.ToLower(obj.Email), role)
+	})
+
+	// Revoking puts the user back to student
+	http.HandleFunc("/admin/role/revoke", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withPermission(w, r, database.PERMISSION_MANAGE_ROLES) {
+			return
+		}
+
+		obj := struct {
+			Email string `json:"email"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		changeRole(w, r, strings.ToLower(obj.Email), database.ROLE_STUDENT)
+	})
+
+	// Expires is a duration like "168h", leave it out for an invite that never expires
+	http.HandleFunc("/admin/invite/create", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withPermission(w, r, database.PERMISSION_MANAGE_INVITE) {
+			return
+		}
+
+		obj := struct {
+			MaxUses int    `json:"maxUses"`
+			Expires string `json:"expires"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		if obj.MaxUses == 0 {
+			obj.MaxUses = 1
+		} else if obj.MaxUses < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var lifetime time.Duration
+
+		if obj.Expires != "" {
+			var err error
+
+			if lifetime, err = time.ParseDuration(obj.Expires); err != nil || lifetime <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		email, _ := r.Cookie("email")
+		admin, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		invite, err := database.CreateInvite(admin.ID, obj.MaxUses, lifetime)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, inviteJSON(invite))
+
+		util.Log.Important(fmt.Sprintf("%s created an invite for %d signups", admin.Email, obj.MaxUses))
+	})
+
+	http.HandleFunc("/admin/invite/list", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withPermission(w, r, database.PERMISSION_MANAGE_INVITE) {
+			return
+		}
+
+		invites, err := database.AllInvites()
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		list := make([]map[string]interface{}, 0)
+
+		for i := range invites {
+			list = append(list, inviteJSON(&invites[i]))
+		}
+
+		writeJSON(w, list)
+	})
+
+	http.HandleFunc("/admin/invite/revoke", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withPermission(w, r, database.PERMISSION_MANAGE_INVITE) {
+			return
+		}
+
+		obj := struct {
+			Code string `json:"code"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		if revoked, err := database.RevokeInvite(obj.Code); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else if !revoked {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusOK)
+
+			admin, _ := r.Cookie("email")
+			util.Log.Important(fmt.Sprintf("%s revoked invite %s", admin.Value, obj.Code))
+		}
+	})
+}
+
+func inviteJSON(invite *database.Invite) map[string]interface{} {
+	var expires, revoked interface{}
+
+	if invite.ExpiresAt != nil {
+		expires = invite.ExpiresAt.Unix()
+	}
+
+	if invite.RevokedAt != nil {
+		revoked = invite.RevokedAt.Unix()
+	}
+
+	return map[string]interface{}{
+		"code":    invite.Code,
+		"maxUses": invite.MaxUses,
+		"uses":    invite.Uses,
+		"created": invite.CreatedAt.Unix(),
+		"expires": expires,
+		"revoked": revoked,
+	}
+}
+
+func changeRole(w http.ResponseWriter, r *http.Request, email string, role database.Role) {
+	admin, _ := r.Cookie("email")
+
+	// Keeps the last admin from locking everyone out
+	if email == admin.Value {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	user, err := database.GetUser(email)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := user.SetRole(role); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(user.JSON())
+
+	util.Log.Important(fmt.Sprintf("%s set the role of %s to %s", admin.Value, email, database.RoleNames[role]))
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/util"
+	"hacknhbackend.eparker.dev/websocket"
+)
+
+const (
+	MAX_CHAT_MESSAGE  = 2000
+	CHAT_HISTORY_SIZE = 50
+
+	// Outgoing messages queued per connection before we give up on it
+	CHAT_SEND_BUFFER = 64
+
+	CHAT_PING_INTERVAL = 30 * time.Second
+	CHAT_READ_TIMEOUT  = 60 * time.Second
+	CHAT_TYPING_EVERY  = 2 * time.Second
+	CHAT_MESSAGE_EVERY = 500 * time.Millisecond
+)
+
+/**
+ * One live chat per section. Every connection gets its own
+ * buffered queue and writer, so a slow reader only ever
+ * holds up itself: once its queue is full it's disconnected
+ * rather than blocking the rest of the room
+ */
+
+type chatClient struct {
+	user *database.User
+	crn  string
+	conn *websocket.Conn
+
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	lastTyping, lastMessage time.Time
+}
+
+var chatRooms map[string]map[*chatClient]bool = make(map[string]map[*chatClient]bool)
+var chatLock sync.Mutex
+
+func (c *chatClient) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close(code, reason)
+	})
+}
+
+// Never blocks, a client that can't keep up is dropped
+func (c *chatClient) queue(message []byte) {
+	select {
+	case <-c.done:
+	case c.send <- message:
+	default:
+		// Closing writes to the socket that's already backed up, so it can't hold up the sender
+		go c.close(websocket.ClosePolicy, "too slow")
+	}
+}
+
+func (c *chatClient) queueJSON(obj interface{}) {
+	message, err := json.Marshal(obj)
+
+	if err != nil {
+		return
+	}
+
+	c.queue(message)
+}
+
+func (c *chatClient) writer() {
+	ticker := time.NewTicker(CHAT_PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case message := <-c.send:
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				c.close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close(websocket.CloseGoingAway, "")
+				return
+			}
+		}
+	}
+}
+
+func joinChat(c *chatClient) {
+	chatLock.Lock()
+	defer chatLock.Unlock()
+
+	if chatRooms[c.crn] == nil {
+		chatRooms[c.crn] = make(map[*chatClient]bool)
+	}
+
+	chatRooms[c.crn][c] = true
+}
+
+func leaveChat(c *chatClient) {
+	chatLock.Lock()
+	defer chatLock.Unlock()
+
+	delete(chatRooms[c.crn], c)
+
+	if len(chatRooms[c.crn]) == 0 {
+		delete(chatRooms, c.crn)
+	}
+}
+
+// A copy of the room, so messages can be built and queued without holding the lock
+func chatMembers(crn string) []*chatClient {
+	chatLock.Lock()
+	defer chatLock.Unlock()
+
+	clients := make([]*chatClient, 0, len(chatRooms[crn]))
+
+	for c := range chatRooms[crn] {
+		clients = append(clients, c)
+	}
+
+	return clients
+}
+
+// Each recipient sees people as much as their privacy settings allow, so messages are built per viewer
+func broadcastChat(crn string, except *chatClient, build func(viewer *database.User) interface{}) {
+	for _, c := range chatMembers(crn) {
+		if c != except {
+			c.queueJSON(build(c.user))
+		}
+	}
+}
+
+func chatMessageJSON(message *database.ChatMessage, author database.UserProfile, viewer *database.User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":     message.ID,
+		"crn":    message.CRN,
+		"author": author,
+		"mine":   message.AuthorID == viewer.ID,
+		"body":   message.Body,
+		"sent":   message.CreatedAt.Unix(),
+	}
+}
+
+func sendChatHistory(c *chatClient, before int) {
+	messages, err := database.ChatHistory(c.crn, before, CHAT_HISTORY_SIZE)
+
+	if err != nil {
+		c.queueJSON(map[string]interface{}{"type": "error", "error": "history unavailable"})
+		return
+	}
+
+	authors := newAuthorCache(c.user)
+	list := make([]map[string]interface{}, 0, len(messages))
+
+	for i := range messages {
+		list = append(list, chatMessageJSON(&messages[i], authors.profile(messages[i].AuthorID), c.user))
+	}
+
+	c.queueJSON(map[string]interface{}{
+		"type":     "history",
+		"messages": list,
+		"more":     len(messages) == CHAT_HISTORY_SIZE,
+	})
+}
+
+/**
+ * Everyone in the room once, however many tabs they have open.
+ * Each connection's user is shared with other goroutines, so the
+ * people shown are loaded fresh, which also picks up privacy
+ * settings changed since they joined
+ */
+func broadcastPresence(crn string) {
+	clients := chatMembers(crn)
+	seen := make(map[int]bool)
+	users := make([]*database.User, 0, len(clients))
+
+	for _, c := range clients {
+		if seen[c.user.ID] {
+			continue
+		}
+
+		seen[c.user.ID] = true
+
+		if user, err := database.GetUserByID(c.user.ID); err == nil {
+			users = append(users, user)
+		}
+	}
+
+	for _, c := range clients {
+		online := make([]database.UserProfile, 0, len(users))
+
+		for _, user := range users {
+			online = append(online, user.Profile(c.user))
+		}
+
+		c.queueJSON(map[string]interface{}{"type": "presence", "users": online})
+	}
+}
+
+func handleChatMessage(c *chatClient, data []byte) {
+	obj := struct {
+		Type   string `json:"type"`
+		Body   string `json:"body"`
+		Before int    `json:"before"`
+	}{}
+
+	if err := json.Unmarshal(data, &obj); err != nil {
+		c.queueJSON(map[string]interface{}{"type": "error", "error": "invalid message"})
+		return
+	}
+
+	switch obj.Type {
+	case "message":
+		if time.Since(c.lastMessage) < CHAT_MESSAGE_EVERY {
+			c.queueJSON(map[string]interface{}{"type": "error", "error": "slow down"})
+			return
+		}
+
+		body := strings.TrimSpace(obj.Body)
+
+		if body == "" || len(body) > MAX_CHAT_MESSAGE {
+			c.queueJSON(map[string]interface{}{"type": "error", "error": "invalid message"})
+			return
+		}
+
+		c.lastMessage = time.Now()
+
+		message, err := database.SaveChatMessage(c.crn, c.user.ID, body)
+
+		if err != nil {
+			c.queueJSON(map[string]interface{}{"type": "error", "error": "message not sent"})
+			return
+		}
+
+		// The author is looked up once, only how they're shown differs per viewer
+		author, err := database.GetUserByID(c.user.ID)
+
+		if err != nil {
+			return
+		}
+
+		broadcastChat(c.crn, nil, func(viewer *database.User) interface{} {
+			obj := chatMessageJSON(message, author.Profile(viewer), viewer)
+			obj["type"] = "message"
+			return obj
+		})
+	case "typing":
+		if time.Since(c.lastTyping) < CHAT_TYPING_EVERY {
+			return
+		}
+
+		c.lastTyping = time.Now()
+
+		author, err := database.GetUserByID(c.user.ID)
+
+		if err != nil {
+			return
+		}
+
+		broadcastChat(c.crn, c, func(viewer *database.User) interface{} {
+			return map[string]interface{}{"type": "typing", "user": author.Profile(viewer)}
+		})
+	case "history":
+		sendChatHistory(c, obj.Before)
+	default:
+		c.queueJSON(map[string]interface{}{"type": "error", "error": "unknown type"})
+	}
+}
+
+func registerChatRoutes() {
+	/**
+	 * Upgrades to a websocket for the section's chat. Clients send
+	 * {"type": "message", "body": ...}, {"type": "typing"} and
+	 * {"type": "history", "before": id}, and get back message,
+	 * typing, presence, history and error events
+	 */
+	http.HandleFunc("/course/chat", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		// Upgrades are GETs, which the CSRF check lets through, so the origin is checked here
+		if origin := r.Header.Get("Origin"); origin != "" && !originAllowed(origin) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		token, _ := r.Cookie("token")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		crn := r.URL.Query().Get("crn")
+
+		if !user.EnrolledIn(crn) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		conn, err := websocket.Upgrade(w, r)
+
+		if err != nil {
+			return
+		}
+
+		conn.ReadTimeout = CHAT_READ_TIMEOUT
+
+		c := &chatClient{
+			user: user,
+			crn:  crn,
+			conn: conn,
+			send: make(chan []byte, CHAT_SEND_BUFFER),
+			done: make(chan struct{}),
+		}
+
+		go c.writer()
+
+		joinChat(c)
+		sendChatHistory(c, 0)
+		broadcastPresence(crn)
+
+		util.Log.Basic(fmt.Sprintf("User %s joined the chat for %s", user.Email, crn))
+
+		defer func() {
+			leaveChat(c)
+			c.close(websocket.CloseNormal, "")
+			broadcastPresence(crn)
+		}()
+
+		for {
+			opcode, data, err := conn.ReadMessage()
+
+			if err != nil {
+				return
+			}
+
+			// Logging out or the session running out ends the chat too
+			if !SessionValid(strings.ToLower(email.Value), token.Value) {
+				c.close(websocket.ClosePolicy, "session expired")
+				return
+			}
+
+			if opcode != websocket.TextMessage {
+				c.close(websocket.CloseUnsupported, "text only")
+				return
+			}
+
+			handleChatMessage(c, data)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"hacknhbackend.eparker.dev/util"
+)
+
+const CSRF_HEADER = "X-CSRF-Token"
+
+// Sessions only live in memory, so the key behind their CSRF tokens can too
+var csrfKey []byte = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// Synchronizer token tied to the session token, a new session means a new CSRF token
+func CSRFTokenFor(sessionToken string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(sessionToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func originAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, allowed := range util.Config.Server.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Browsers that strip Origin still send a Referer we can fall back on
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+
+	if referer, err := url.Parse(r.Header.Get("Referer")); err == nil && referer.Host != "" {
+		return referer.Scheme + "://" + referer.Host
+	}
+
+	return ""
+}
+
+/**
+ * Wraps every handler, so state-changing requests are
+ * covered no matter which endpoint they hit:
+ *  - they have to come from an allowed origin (when the browser says where from)
+ *  - if they carry a live session, they also need its CSRF token in the header
+ */
+func withCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+			next.ServeHTTP(w, r)
+			return
+		case "OPTIONS":
+			// Preflight, needed now that the CSRF header isn't a "simple" one
+			withCors(w, r)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if origin := requestOrigin(r); origin != "" && !originAllowed(origin) {
+			withCors(w, r)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// A stale session cookie shouldn't get in the way of logging back in
+		email, emailErr := r.Cookie("email")
+		token, tokenErr := r.Cookie("token")
+
+		if emailErr == nil && tokenErr == nil && SessionValid(strings.ToLower(email.Value), token.Value) {
+			if !hmac.Equal([]byte(r.Header.Get(CSRF_HEADER)), []byte(CSRFTokenFor(token.Value))) {
+				withCors(w, r)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func registerCSRFRoutes() {
+	// The CSRF token for the current session
+	http.HandleFunc("/user/csrf", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		token, _ := r.Cookie("token")
+		w.Header().Set(CSRF_HEADER, CSRFTokenFor(token.Value))
+
+		if jsonToken, err := json.Marshal(map[string]string{"token": CSRFTokenFor(token.Value)}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonToken)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"math"
+	"time"
+)
+
+type ChatMessage struct {
+	ID, AuthorID int
+	CRN, Body    string
+	CreatedAt    time.Time
+}
+
+func SaveChatMessage(crn string, authorID int, body string) (*ChatMessage, error) {
+	now := time.Now()
+
+	result, err := QueuedExecResult("INSERT INTO chat_messages (term_crn, author_id, body, created_at) VALUES (?, ?, ?, ?);", crn, authorID, body, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChatMessage{ID: int(id), AuthorID: authorID, CRN: crn, Body: body, CreatedAt: now}, nil
+}
+
+// Up to limit messages sent before the given id (0 for the newest), oldest first
+func ChatHistory(crn string, before, limit int) ([]ChatMessage, error) {
+	if before <= 0 {
+		before = math.MaxInt
+	}
+
+	rows, err := QueuedQuery("SELECT id, term_crn, author_id, body, created_at FROM chat_messages WHERE term_crn = ? AND id < ? ORDER BY id DESC LIMIT ?;", crn, before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	messages := make([]ChatMessage, 0)
+
+	for rows.Next() {
+		var m ChatMessage
+		var created int64
+
+		if err := rows.Scan(&m.ID, &m.CRN, &m.AuthorID, &m.Body, &created); err != nil {
+			return nil, err
+		}
+
+		m.CreatedAt = time.Unix(created, 0)
+		messages = append(messages, m)
+	}
+
+	// Selected newest first so the limit keeps the most recent ones
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages, rows.Err()
+}
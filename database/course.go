@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"hacknhbackend.eparker.dev/courseload"
+	"hacknhbackend.eparker.dev/events"
 	"hacknhbackend.eparker.dev/util"
 )
 
@@ -14,6 +15,23 @@ func CourseUpdates() {
 	courses := courseload.LoadCourses()
 	util.Log.Basic(fmt.Sprintf("Loaded %d courses in %v", len(courses), time.Since(start)))
 
+	SyncCourses(courses)
+}
+
+/**
+ * Brings the stored catalog in line with the one just loaded:
+ *  - new sections are inserted
+ *  - sections that changed are rewritten, and the students in
+ *    them are notified when they moved, were retimed or re-staffed
+ *  - sections that are gone are deleted, again notifying students
+ */
+func SyncCourses(courses []courseload.Course) {
+	// A failed load shouldn't look like every section being cancelled
+	if len(courses) == 0 {
+		util.Log.Error("Course sync loaded no courses, leaving the catalog as it is")
+		return
+	}
+
 	crns, err := GetCourseCRNs()
 
 	if err != nil {
@@ -33,10 +51,14 @@ func CourseUpdates() {
 		crnsMap[course.CRN] = 1
 	}
 
-	var inserts, deletes int = 0, 0
+	var inserts, updates, deletes, notified int = 0, 0, 0, 0
 
 	for _, crn := range crns {
 		if _, ok := crnsMap[crn]; !ok {
+			if course, err := GetCourse(crn); err == nil {
+				notified += notifyCourseDeleted(course)
+			}
+
 			DeleteCourse(crn)
 			deletes++
 		} else {
@@ -44,6 +66,25 @@ func CourseUpdates() {
 		}
 	}
 
+	// Compared before the transaction starts, the lookups would otherwise wait on it
+	changed := make([]courseload.Course, 0)
+	changes := make(map[string][]CourseChange)
+
+	for _, course := range courses {
+		if crnsMap[course.CRN] != 2 {
+			continue
+		}
+
+		stored, err := GetCourse(course.CRN)
+
+		if err != nil || sameCourse(stored, &course) {
+			continue
+		}
+
+		changed = append(changed, course)
+		changes[course.CRN] = courseChanges(stored, &course)
+	}
+
 	// Transaction
 	transaction, err := QueuedBegin()
 
@@ -54,22 +95,29 @@ func CourseUpdates() {
 
 	for _, course := range courses {
 		if crnsMap[course.CRN] == 1 {
-			// InsertCourse(course)
-
-			transaction.Exec(INSERT_COURSE_STATEMENT, course.CRN, course.Data.Title, course.Data.Subject, course.Data.Number, course.Data.SectionNum, course.Data.Description)
-
-			for _, instructor := range course.Data.Instructors {
-				transaction.Exec(INSERT_INSTUCTOR_STATEMENT, instructor.LastName, instructor.FirstName, instructor.Email, course.CRN)
+			if _, err := transaction.Exec(INSERT_COURSE_STATEMENT, course.CRN, course.Data.Title, course.Data.Subject, course.Data.Number, course.Data.SectionNum, course.Data.Description); err != nil {
+				abortCourseSync(transaction, course.CRN, err)
+				return
 			}
 
-			for _, meeting := range course.Data.Meetings {
-				transaction.Exec(INSERT_MEETING_STATEMENT, meeting.Days, meeting.Building, meeting.Room, meeting.Time, course.CRN)
+			if err := insertCourseDetails(transaction, course); err != nil {
+				abortCourseSync(transaction, course.CRN, err)
+				return
 			}
 
 			inserts++
 		}
 	}
 
+	for _, course := range changed {
+		if err := updateCourse(transaction, course); err != nil {
+			abortCourseSync(transaction, course.CRN, err)
+			return
+		}
+
+		updates++
+	}
+
 	err = transaction.Commit()
 
 	if err != nil {
@@ -77,7 +125,53 @@ func CourseUpdates() {
 		return
 	}
 
-	util.Log.Status(fmt.Sprintf("Inserted %d courses, deleted %d courses", inserts, deletes))
+	// Only once the new details are actually stored
+	for crn, list := range changes {
+		notified += notifyCourseChanges(crn, list)
+	}
+
+	util.Log.Status(fmt.Sprintf("Inserted %d courses, updated %d courses, deleted %d courses, sent %d notifications", inserts, updates, deletes, notified))
+
+	events.Broadcast(events.SYNC_COMPLETED, map[string]int{"inserted": inserts, "updated": updates, "deleted": deletes, "notified": notified})
+}
+
+// Nothing from the sync is kept, and nobody is notified about changes that weren't stored
+func abortCourseSync(transaction *sql.Tx, crn string, err error) {
+	util.Log.Error(fmt.Sprintf("Error writing course %s, rolling back the sync: %v", crn, err))
+	transaction.Rollback()
+}
+
+func insertCourseDetails(transaction *sql.Tx, course courseload.Course) error {
+	for _, instructor := range course.Data.Instructors {
+		if _, err := transaction.Exec(INSERT_INSTUCTOR_STATEMENT, instructor.LastName, instructor.FirstName, instructor.Email, course.CRN); err != nil {
+			return err
+		}
+	}
+
+	for _, meeting := range course.Data.Meetings {
+		if _, err := transaction.Exec(INSERT_MEETING_STATEMENT, meeting.Days, meeting.Building, meeting.Room, meeting.Time, course.CRN); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func updateCourse(transaction *sql.Tx, course courseload.Course) error {
+	if _, err := transaction.Exec("UPDATE courses SET title = ?, subject_code = ?, course_number = ?, section_number = ?, description = ? WHERE term_crn = ?;",
+		course.Data.Title, course.Data.Subject, course.Data.Number, course.Data.SectionNum, course.Data.Description, course.CRN); err != nil {
+		return err
+	}
+
+	if _, err := transaction.Exec("DELETE FROM instructors WHERE term_crn = ?;", course.CRN); err != nil {
+		return err
+	}
+
+	if _, err := transaction.Exec("DELETE FROM meetings WHERE term_crn = ?;", course.CRN); err != nil {
+		return err
+	}
+
+	return insertCourseDetails(transaction, course)
 }
 
 func InsertCourse(course courseload.Course) error {
@@ -119,6 +213,12 @@ func DeleteCourse(term_crn string) error {
 		return err
 	}
 
+	// Nobody can take a section that no longer exists
+	err = QueuedExec("DELETE FROM user_courses WHERE term_crn = ?;", term_crn)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
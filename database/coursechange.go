@@ -0,0 +1,160 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"hacknhbackend.eparker.dev/courseload"
+	"hacknhbackend.eparker.dev/events"
+	"hacknhbackend.eparker.dev/util"
+)
+
+// Something about a section that students taking it should hear about
+type CourseChange struct {
+	Kind    string   `json:"kind"`
+	Message string   `json:"message"`
+	Before  []string `json:"before"`
+	After   []string `json:"after"`
+}
+
+func courseLabel(course *courseload.Course) string {
+	return fmt.Sprintf("%s %s-%s (%s)", course.Data.Subject, course.Data.Number, course.Data.SectionNum, course.Data.Title)
+}
+
+func meetingLocations(meetings []courseload.Meeting) []string {
+	list := make([]string, 0, len(meetings))
+
+	for _, meeting := range meetings {
+		list = append(list, strings.TrimSpace(meeting.Building+" "+meeting.Room))
+	}
+
+	return list
+}
+
+func meetingTimes(meetings []courseload.Meeting) []string {
+	list := make([]string, 0, len(meetings))
+
+	for _, meeting := range meetings {
+		list = append(list, strings.TrimSpace(meeting.Days+" "+meeting.Time))
+	}
+
+	return list
+}
+
+func instructorNames(instructors []courseload.Instructor) []string {
+	list := make([]string, 0, len(instructors))
+
+	for _, instructor := range instructors {
+		list = append(list, strings.TrimSpace(instructor.FirstName+" "+instructor.LastName))
+	}
+
+	return list
+}
+
+// Order doesn't matter, the catalog doesn't keep it stable
+func sameList(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+
+	return slices.Equal(a, b)
+}
+
+func listOrTBA(list []string) string {
+	if len(list) == 0 {
+		return "TBA"
+	}
+
+	return strings.Join(list, ", ")
+}
+
+// Like sameList, for whole instructors and meetings
+func sameItems[T comparable](a, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[T]int)
+
+	for _, item := range a {
+		counts[item]++
+	}
+
+	for _, item := range b {
+		if counts[item] == 0 {
+			return false
+		}
+
+		counts[item]--
+	}
+
+	return true
+}
+
+// Whether anything at all differs, including details nobody gets told about
+func sameCourse(a, b *courseload.Course) bool {
+	return a.CRN == b.CRN && a.Data.Title == b.Data.Title && a.Data.Subject == b.Data.Subject && a.Data.Number == b.Data.Number &&
+		a.Data.SectionNum == b.Data.SectionNum && a.Data.Description == b.Data.Description &&
+		sameItems(a.Data.Instructors, b.Data.Instructors) && sameItems(a.Data.Meetings, b.Data.Meetings)
+}
+
+// What changed between the stored section and the one from the catalog
+func courseChanges(before, after *courseload.Course) []CourseChange {
+	changes := make([]CourseChange, 0)
+	label := courseLabel(after)
+
+	if was, now := meetingLocations(before.Data.Meetings), meetingLocations(after.Data.Meetings); !sameList(was, now) {
+		changes = append(changes, CourseChange{NOTIFICATION_COURSE_MOVED, fmt.Sprintf("%s moved to %s", label, listOrTBA(now)), was, now})
+	}
+
+	if was, now := meetingTimes(before.Data.Meetings), meetingTimes(after.Data.Meetings); !sameList(was, now) {
+		changes = append(changes, CourseChange{NOTIFICATION_COURSE_RETIMED, fmt.Sprintf("%s now meets %s", label, listOrTBA(now)), was, now})
+	}
+
+	if was, now := instructorNames(before.Data.Instructors), instructorNames(after.Data.Instructors); !sameList(was, now) {
+		changes = append(changes, CourseChange{NOTIFICATION_COURSE_RESTAFFED, fmt.Sprintf("%s is now taught by %s", label, listOrTBA(now)), was, now})
+	}
+
+	return changes
+}
+
+func notifyCourseChanges(crn string, changes []CourseChange) int {
+	if len(changes) == 0 {
+		return 0
+	}
+
+	events.Broadcast(events.COURSE_CHANGED, map[string]interface{}{"crn": crn, "deleted": false, "changes": changes})
+
+	sent := 0
+
+	for _, change := range changes {
+		count, err := NotifyCourse(crn, change.Kind, change.Message, map[string][]string{"before": change.Before, "after": change.After})
+
+		if err != nil {
+			util.Log.Error(fmt.Sprintf("Error notifying %s of a change: %v", crn, err))
+			continue
+		}
+
+		sent += count
+	}
+
+	return sent
+}
+
+func notifyCourseDeleted(course *courseload.Course) int {
+	events.Broadcast(events.COURSE_CHANGED, map[string]interface{}{"crn": course.CRN, "deleted": true, "changes": []CourseChange{}})
+
+	count, err := NotifyCourse(course.CRN, NOTIFICATION_COURSE_DELETED, courseLabel(course)+" was removed from the catalog", map[string]string{
+		"subject": course.Data.Subject,
+		"number":  course.Data.Number,
+		"section": course.Data.SectionNum,
+		"title":   course.Data.Title,
+	})
+
+	if err != nil {
+		util.Log.Error(fmt.Sprintf("Error notifying %s of its removal: %v", course.CRN, err))
+	}
+
+	return count
+}
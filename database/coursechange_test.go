@@ -0,0 +1,82 @@
+package database
+
+import (
+	"slices"
+	"testing"
+
+	"hacknhbackend.eparker.dev/courseload"
+)
+
+func testCourse() *courseload.Course {
+	return &courseload.Course{
+		CRN: "202510-1",
+		Data: courseload.CourseData{
+			Title:       "Intro to Programming",
+			Subject:     "CS",
+			Number:      "101",
+			SectionNum:  "01",
+			Description: "Programs",
+			Instructors: []courseload.Instructor{{FirstName: "Ada", LastName: "Lovelace"}, {FirstName: "Alan", LastName: "Turing"}},
+			Meetings:    []courseload.Meeting{{Days: "MW", Time: "9:00-10:15", Building: "Kingsbury", Room: "N101"}},
+		},
+	}
+}
+
+func TestCourseChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *courseload.Course)
+		same   bool
+		kinds  []string
+	}{
+		{"nothing", func(c *courseload.Course) {}, true, nil},
+		{"description only", func(c *courseload.Course) { c.Data.Description = "More programs" }, false, nil},
+		{"instructors reordered", func(c *courseload.Course) {
+			c.Data.Instructors[0], c.Data.Instructors[1] = c.Data.Instructors[1], c.Data.Instructors[0]
+		}, true, nil},
+		{"room", func(c *courseload.Course) { c.Data.Meetings[0].Room = "N102" }, false, []string{NOTIFICATION_COURSE_MOVED}},
+		{"time", func(c *courseload.Course) { c.Data.Meetings[0].Time = "11:00-12:15" }, false, []string{NOTIFICATION_COURSE_RETIMED}},
+		{"instructor", func(c *courseload.Course) { c.Data.Instructors = c.Data.Instructors[:1] }, false, []string{NOTIFICATION_COURSE_RESTAFFED}},
+		{"meetings dropped", func(c *courseload.Course) { c.Data.Meetings = nil }, false, []string{NOTIFICATION_COURSE_MOVED, NOTIFICATION_COURSE_RETIMED}},
+		{"everything", func(c *courseload.Course) {
+			c.Data.Meetings[0] = courseload.Meeting{Days: "TR", Time: "1:00-2:15", Building: "Parsons", Room: "G01"}
+			c.Data.Instructors = []courseload.Instructor{{FirstName: "Grace", LastName: "Hopper"}}
+		}, false, []string{NOTIFICATION_COURSE_MOVED, NOTIFICATION_COURSE_RETIMED, NOTIFICATION_COURSE_RESTAFFED}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before, after := testCourse(), testCourse()
+			test.change(after)
+
+			if same := sameCourse(before, after); same != test.same {
+				t.Errorf("sameCourse = %v, want %v", same, test.same)
+			}
+
+			kinds := make([]string, 0)
+
+			for _, change := range courseChanges(before, after) {
+				kinds = append(kinds, change.Kind)
+			}
+
+			if !slices.Equal(kinds, test.kinds) && !(len(kinds) == 0 && len(test.kinds) == 0) {
+				t.Errorf("got changes %v, want %v", kinds, test.kinds)
+			}
+		})
+	}
+}
+
+func TestCourseChangeMessages(t *testing.T) {
+	before, after := testCourse(), testCourse()
+	after.Data.Meetings = nil
+
+	changes := courseChanges(before, after)
+
+	if len(changes) != 2 || changes[0].Message != "CS 101-01 (Intro to Programming) moved to TBA" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	if !slices.Equal(changes[0].Before, []string{"Kingsbury N101"}) || len(changes[0].After) != 0 {
+		t.Fatalf("got before %v after %v", changes[0].Before, changes[0].After)
+	}
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+var ErrorDeletionNotDue error = fmt.Errorf("account isn't due for deletion")
+
+// When the account is due to be deleted, nil if it isn't
+func (u *User) DeletionScheduled() (*time.Time, error) {
+	var at *int64
+
+	if err := QueuedQueryRow("SELECT delete_at FROM users WHERE id = ?;", u.ID).Scan(&at); err != nil {
+		return nil, err
+	}
+
+	return optionalTime(at), nil
+}
+
+func (u *User) ScheduleDeletion(at time.Time) error {
+	return QueuedExec("UPDATE users SET delete_at = ? WHERE id = ?;", at.Unix(), u.ID)
+}
+
+// Whether there was a deletion to cancel
+func (u *User) CancelDeletion() (bool, error) {
+	result, err := QueuedExecResult("UPDATE users SET delete_at = NULL WHERE id = ? AND delete_at IS NOT NULL;", u.ID)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	return affected > 0, err
+}
+
+// Accounts whose grace period is over
+func UsersDueForDeletion() ([]User, error) {
+	rows, err := QueuedQuery("SELECT id, email, first_name, last_name, password, privilege, verified, major, graduation_year, pronouns, bio, contacts FROM users WHERE delete_at IS NOT NULL AND delete_at <= ?;", time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	users := make([]User, 0)
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, *user)
+	}
+
+	return users, rows.Err()
+}
+
+// Everything that's only the user's, each statement takes their id as ?1
+var deleteStatements = []string{
+	"DELETE FROM direct_messages WHERE conversation_id IN (SELECT id FROM conversations WHERE user_low = ?1 OR user_high = ?1);",
+	"DELETE FROM conversations WHERE user_low = ?1 OR user_high = ?1;",
+	"DELETE FROM chat_messages WHERE author_id = ?1;",
+	"DELETE FROM notifications WHERE user_id = ?1;",
+	"DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE owner_id = ?1);",
+	"DELETE FROM webhooks WHERE owner_id = ?1;",
+	"DELETE FROM data_exports WHERE user_id = ?1;",
+	"DELETE FROM one_time_tokens WHERE user_id = ?1;",
+	"DELETE FROM totp WHERE user_id = ?1;",
+	"DELETE FROM recovery_codes WHERE user_id = ?1;",
+	"DELETE FROM passkeys WHERE user_id = ?1;",
+	"DELETE FROM privacy_settings WHERE user_id = ?1;",
+	"DELETE FROM user_courses WHERE user_id = ?1;",
+	"DELETE FROM connections WHERE requester_id = ?1 OR addressee_id = ?1;",
+	"DELETE FROM blocks WHERE blocker_id = ?1 OR blocked_id = ?1;",
+	"DELETE FROM study_group_members WHERE user_id = ?1;",
+	"DELETE FROM users WHERE id = ?1;",
+}
+
+/**
+ * Removes the account for good, unless the deletion was cancelled or pushed back since it was loaded:
+ *  - study groups are left first, so owned groups pass to someone else
+ *  - posts in shared threads are blanked and marked deleted by their author,
+ *    the same as deleting them by hand, so the threads around them still work
+ *  - invites they made stop working but are kept, others signed up with them
+ *  - everything else about them, conversations included, is deleted
+ */
+func DeleteUser(id int) error {
+	now := time.Now().Unix()
+
+	tx, err := QueuedBegin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var due int
+
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ? AND delete_at IS NOT NULL AND delete_at <= ?;", id, now).Scan(&due); err != nil {
+		return err
+	} else if due == 0 {
+		return ErrorDeletionNotDue
+	}
+
+	groups, err := memberGroupIDs(tx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if err := leaveStudyGroup(tx, group, id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE threads SET title = '', body = '', deleted_at = COALESCE(deleted_at, ?2), deleted_by = COALESCE(deleted_by, ?1) WHERE author_id = ?1;", id, now); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE replies SET body = '', deleted_at = COALESCE(deleted_at, ?2), deleted_by = COALESCE(deleted_by, ?1) WHERE author_id = ?1;", id, now); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE invites SET revoked_at = ?2 WHERE created_by = ?1 AND revoked_at IS NULL;", id, now); err != nil {
+		return err
+	}
+
+	for _, statement := range deleteStatements {
+		if _, err := tx.Exec(statement, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func memberGroupIDs(tx *sql.Tx, userID int) ([]int, error) {
+	rows, err := tx.Query("SELECT group_id FROM study_group_members WHERE user_id = ?;", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ids := make([]int, 0)
+
+	for rows.Next() {
+		var id int
+
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
@@ -0,0 +1,198 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func count(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
+
+	var n int
+
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+// Gives the user a row in every table deleteStatements clears, with other as the second party
+func seedEverything(t *testing.T, user, other *User, credential string) {
+	t.Helper()
+
+	check := func(err error) {
+		t.Helper()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conversation, err := ConversationBetween(user.ID, other.ID)
+	check(err)
+	_, err = SendDirectMessage(conversation.ID, user.ID, "hello")
+	check(err)
+
+	check(user.AddClass(testCourse().CRN))
+	_, err = SaveChatMessage(testCourse().CRN, user.ID, "hi all")
+	check(err)
+
+	hook, err := CreateWebhook(user.ID, "https://example.edu/hook", []string{"sync.completed"}, false)
+	check(err)
+	check(QueueDelivery(hook.ID, "sync.completed", "{}"))
+
+	check(StartDataExport(user.ID, "json"))
+	_, err = CreateOneTimeToken(user.ID, TOKEN_PURPOSE_PASSWORD_RESET, user.Email, time.Hour)
+	check(err)
+
+	check(SetPendingTOTP(user.ID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"))
+	_, err = CreateRecoveryCodes(user.ID)
+	check(err)
+	check(AddPasskey(user.ID, credential, []byte{1}, 0, "laptop"))
+
+	check(user.SetPrivacy(PRIVACY_FIELD_EMAIL, VISIBILITY_HIDDEN))
+	_, err = SendFriendRequest(user.ID, other.ID)
+	check(err)
+	check(BlockUser(user.ID, other.ID))
+}
+
+func TestDeleteUserClearsEverything(t *testing.T) {
+	OpenTestDatabase(t)
+	gone := createTestUser(t, "gone@example.edu")
+	keeper := createTestUser(t, "keeper@example.edu")
+	bystander := createTestUser(t, "bystander@example.edu")
+
+	if err := InsertCourse(*testCourse()); err != nil {
+		t.Fatal(err)
+	}
+
+	seedEverything(t, gone, keeper, "gone-key")
+	seedEverything(t, keeper, bystander, "keeper-key")
+
+	if _, err := NotifyCourse(testCourse().CRN, NOTIFICATION_COURSE_MOVED, "moved", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	shared, err := CreateStudyGroup(gone.ID, StudyGroup{CRN: testCourse().CRN, Name: "Shared", Capacity: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := JoinStudyGroup(shared.ID, keeper.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	alone, err := CreateStudyGroup(gone.ID, StudyGroup{CRN: testCourse().CRN, Name: "Alone", Capacity: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	theirs, err := CreateThread(testCourse().CRN, gone.ID, "Question", "How?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer, err := CreateReply(theirs.ID, keeper.ID, "Like this")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := CreateThread(testCourse().CRN, keeper.ID, "Another", "Why?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateReply(other.ID, gone.ID, "Because"); err != nil {
+		t.Fatal(err)
+	}
+
+	invite, err := CreateInvite(gone.ID, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteUser(gone.ID); err != ErrorDeletionNotDue {
+		t.Fatalf("deleting before it was scheduled: got %v, want ErrorDeletionNotDue", err)
+	}
+
+	if err := gone.ScheduleDeletion(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteUser(gone.ID); err != ErrorDeletionNotDue {
+		t.Fatalf("deleting before the grace period was over: got %v, want ErrorDeletionNotDue", err)
+	}
+
+	if count(t, "SELECT COUNT(*) FROM study_group_members WHERE user_id = ?;", gone.ID) != 2 {
+		t.Fatal("left study groups without being deleted")
+	}
+
+	if err := gone.ScheduleDeletion(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteUser(gone.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each counts rows still tied to ?1
+	tied := map[string]string{
+		"direct_messages":     "SELECT COUNT(*) FROM direct_messages WHERE sender_id = ?1;",
+		"conversations":       "SELECT COUNT(*) FROM conversations WHERE user_low = ?1 OR user_high = ?1;",
+		"chat_messages":       "SELECT COUNT(*) FROM chat_messages WHERE author_id = ?1;",
+		"notifications":       "SELECT COUNT(*) FROM notifications WHERE user_id = ?1;",
+		"webhook_deliveries":  "SELECT COUNT(*) FROM webhook_deliveries JOIN webhooks ON webhooks.id = webhook_id WHERE owner_id = ?1;",
+		"webhooks":            "SELECT COUNT(*) FROM webhooks WHERE owner_id = ?1;",
+		"data_exports":        "SELECT COUNT(*) FROM data_exports WHERE user_id = ?1;",
+		"one_time_tokens":     "SELECT COUNT(*) FROM one_time_tokens WHERE user_id = ?1;",
+		"totp":                "SELECT COUNT(*) FROM totp WHERE user_id = ?1;",
+		"recovery_codes":      "SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?1;",
+		"passkeys":            "SELECT COUNT(*) FROM passkeys WHERE user_id = ?1;",
+		"privacy_settings":    "SELECT COUNT(*) FROM privacy_settings WHERE user_id = ?1;",
+		"user_courses":        "SELECT COUNT(*) FROM user_courses WHERE user_id = ?1;",
+		"connections":         "SELECT COUNT(*) FROM connections WHERE requester_id = ?1 OR addressee_id = ?1;",
+		"blocks":              "SELECT COUNT(*) FROM blocks WHERE blocker_id = ?1 OR blocked_id = ?1;",
+		"study_group_members": "SELECT COUNT(*) FROM study_group_members WHERE user_id = ?1;",
+		"users":               "SELECT COUNT(*) FROM users WHERE id = ?1;",
+	}
+
+	if len(tied) != len(deleteStatements) {
+		t.Fatalf("checking %d tables, deleteStatements clears %d", len(tied), len(deleteStatements))
+	}
+
+	for table, query := range tied {
+		if n := count(t, query, gone.ID); n != 0 {
+			t.Errorf("%s: %d rows left for the deleted user", table, n)
+		}
+
+		if n := count(t, query, keeper.ID); n == 0 {
+			t.Errorf("%s: the other user's rows went too", table)
+		}
+	}
+
+	if _, err := GetStudyGroup(alone.ID, keeper.ID); err == nil {
+		t.Error("the group they were alone in is still there")
+	}
+
+	if group, err := GetStudyGroup(shared.ID, keeper.ID); err != nil || group.Role != GROUP_ROLE_OWNER {
+		t.Errorf("shared group: got %+v (%v), want the keeper to own it", group, err)
+	}
+
+	for _, post := range []struct{ table, query string }{
+		{"threads", "SELECT COUNT(*) FROM threads WHERE author_id = ?1 AND title = '' AND body = '' AND deleted_by = ?1;"},
+		{"replies", "SELECT COUNT(*) FROM replies WHERE author_id = ?1 AND body = '' AND deleted_by = ?1;"},
+	} {
+		if n := count(t, post.query, gone.ID); n != 1 {
+			t.Errorf("%s: %d blanked posts, want 1", post.table, n)
+		}
+	}
+
+	if n := count(t, "SELECT COUNT(*) FROM replies WHERE id = ? AND body = 'Like this' AND deleted_at IS NULL;", answer.ID); n != 1 {
+		t.Error("the reply under their thread was touched")
+	}
+
+	if n := count(t, "SELECT COUNT(*) FROM invites WHERE id = ? AND revoked_at IS NOT NULL;", invite.ID); n != 1 {
+		t.Error("their invite wasn't kept and revoked")
+	}
+}
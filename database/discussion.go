@@ -0,0 +1,188 @@
+package database
+
+import (
+	"time"
+)
+
+type Thread struct {
+	ID, AuthorID, Replies int
+	CRN, Title, Body      string
+	CreatedAt, ActivityAt time.Time
+	EditedAt              *time.Time
+}
+
+type Reply struct {
+	ID, ThreadID, AuthorID int
+	Body                   string
+	CreatedAt              time.Time
+	EditedAt               *time.Time
+}
+
+func optionalTime(unix *int64) *time.Time {
+	if unix == nil {
+		return nil
+	}
+
+	t := time.Unix(*unix, 0)
+	return &t
+}
+
+const selectThreads = `SELECT id, term_crn, author_id, title, body, created_at, edited_at, last_activity_at,
+    (SELECT COUNT(*) FROM replies WHERE thread_id = threads.id AND deleted_at IS NULL) FROM threads `
+
+func scanThread(row scanner) (*Thread, error) {
+	var t Thread
+	var created, activity int64
+	var edited *int64
+
+	if err := row.Scan(&t.ID, &t.CRN, &t.AuthorID, &t.Title, &t.Body, &created, &edited, &activity, &t.Replies); err != nil {
+		return nil, err
+	}
+
+	t.CreatedAt = time.Unix(created, 0)
+	t.ActivityAt = time.Unix(activity, 0)
+	t.EditedAt = optionalTime(edited)
+
+	return &t, nil
+}
+
+const selectReplies = `SELECT id, thread_id, author_id, body, created_at, edited_at FROM replies `
+
+func scanReply(row scanner) (*Reply, error) {
+	var r Reply
+	var created int64
+	var edited *int64
+
+	if err := row.Scan(&r.ID, &r.ThreadID, &r.AuthorID, &r.Body, &created, &edited); err != nil {
+		return nil, err
+	}
+
+	r.CreatedAt = time.Unix(created, 0)
+	r.EditedAt = optionalTime(edited)
+
+	return &r, nil
+}
+
+func CreateThread(crn string, authorID int, title, body string) (*Thread, error) {
+	now := time.Now().Unix()
+
+	result, err := QueuedExecResult("INSERT INTO threads (term_crn, author_id, title, body, created_at, last_activity_at) VALUES (?, ?, ?, ?, ?, ?);", crn, authorID, title, body, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return GetThread(int(id))
+}
+
+// Deleted threads can't be fetched
+func GetThread(id int) (*Thread, error) {
+	return scanThread(QueuedQueryRow(selectThreads+"WHERE id = ? AND deleted_at IS NULL;", id))
+}
+
+// A page of the course's threads, most recently active first, and how many there are in all
+func CourseThreads(crn string, limit, offset int) ([]Thread, int, error) {
+	var total int
+
+	if err := QueuedQueryRow("SELECT COUNT(*) FROM threads WHERE term_crn = ? AND deleted_at IS NULL;", crn).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := QueuedQuery(selectThreads+"WHERE term_crn = ? AND deleted_at IS NULL ORDER BY last_activity_at DESC, id DESC LIMIT ? OFFSET ?;", crn, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	threads := make([]Thread, 0)
+
+	for rows.Next() {
+		t, err := scanThread(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		threads = append(threads, *t)
+	}
+
+	return threads, total, rows.Err()
+}
+
+func (t *Thread) Edit(title, body string) error {
+	t.Title, t.Body = title, body
+	now := time.Now()
+	t.EditedAt = &now
+
+	return QueuedExec("UPDATE threads SET title = ?, body = ?, edited_at = ? WHERE id = ?;", title, body, now.Unix(), t.ID)
+}
+
+// by is whoever deleted it, the author or a moderator
+func (t *Thread) Delete(by int) error {
+	return QueuedExec("UPDATE threads SET deleted_at = ?, deleted_by = ? WHERE id = ?;", time.Now().Unix(), by, t.ID)
+}
+
+// Replying bumps the thread back to the top of the course
+func CreateReply(threadID, authorID int, body string) (*Reply, error) {
+	now := time.Now().Unix()
+
+	result, err := QueuedExecResult("INSERT INTO replies (thread_id, author_id, body, created_at) VALUES (?, ?, ?, ?);", threadID, authorID, body, now)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := QueuedExec("UPDATE threads SET last_activity_at = ? WHERE id = ?;", now, threadID); err != nil {
+		return nil, err
+	}
+
+	return GetReply(int(id))
+}
+
+// Deleted replies, and replies in deleted threads, can't be fetched
+func GetReply(id int) (*Reply, error) {
+	return scanReply(QueuedQueryRow(selectReplies+"WHERE id = ? AND deleted_at IS NULL AND thread_id IN (SELECT id FROM threads WHERE deleted_at IS NULL);", id))
+}
+
+// A page of the thread's replies, oldest first
+func ThreadReplies(threadID, limit, offset int) ([]Reply, error) {
+	rows, err := QueuedQuery(selectReplies+"WHERE thread_id = ? AND deleted_at IS NULL ORDER BY created_at, id LIMIT ? OFFSET ?;", threadID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	replies := make([]Reply, 0)
+
+	for rows.Next() {
+		r, err := scanReply(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		replies = append(replies, *r)
+	}
+
+	return replies, rows.Err()
+}
+
+func (r *Reply) Edit(body string) error {
+	r.Body = body
+	now := time.Now()
+	r.EditedAt = &now
+
+	return QueuedExec("UPDATE replies SET body = ?, edited_at = ? WHERE id = ?;", body, now.Unix(), r.ID)
+}
+
+func (r *Reply) Delete(by int) error {
+	return QueuedExec("UPDATE replies SET deleted_at = ?, deleted_by = ? WHERE id = ?;", time.Now().Unix(), by, r.ID)
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Moves enrollments out of the comma-joined users.classes column, which
+// is emptied as it goes
+func migrateClassesColumn(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, classes FROM users WHERE classes != '';")
+	if err != nil {
+		return err
+	}
+
+	enrollments := make(map[int][]string)
+
+	for rows.Next() {
+		var id int
+		var classes string
+
+		if err := rows.Scan(&id, &classes); err != nil {
+			rows.Close()
+			return err
+		}
+
+		for _, class := range strings.Split(classes, ",") {
+			if class != "" {
+				enrollments[id] = append(enrollments[id], class)
+			}
+		}
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+
+	for id, classes := range enrollments {
+		for _, class := range classes {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO user_courses (user_id, term_crn, added_at) VALUES (?, ?, ?);", id, class, now); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec("UPDATE users SET classes = '' WHERE classes != '';")
+	return err
+}
+
+func userCourses(userID int) ([]string, error) {
+	rows, err := QueuedQuery("SELECT term_crn FROM user_courses WHERE user_id = ? ORDER BY added_at, rowid;", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var courses []string
+
+	for rows.Next() {
+		var crn string
+
+		if err := rows.Scan(&crn); err != nil {
+			return nil, err
+		}
+
+		courses = append(courses, crn)
+	}
+
+	return courses, rows.Err()
+}
+
+// Fills in courses for a whole list, a query per few hundred users
+func loadCourses(users []User) error {
+	index := make(map[int]*User, len(users))
+	ids := make([]interface{}, len(users))
+
+	for i := range users {
+		users[i].Courses = nil
+		index[users[i].ID] = &users[i]
+		ids[i] = users[i].ID
+	}
+
+	batches, placeholders := idBatches(ids)
+
+	for i, batch := range batches {
+		if err := loadCourseBatch(index, placeholders[i], batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadCourseBatch(index map[int]*User, placeholders string, ids []interface{}) error {
+	rows, err := QueuedQuery("SELECT user_id, term_crn FROM user_courses WHERE user_id IN ("+placeholders+") ORDER BY added_at, rowid;", ids...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var crn string
+
+		if err := rows.Scan(&id, &crn); err != nil {
+			return err
+		}
+
+		index[id].Courses = append(index[id].Courses, crn)
+	}
+
+	return rows.Err()
+}
+
+func (u *User) EnrolledIn(crn string) bool {
+	for _, class := range u.Courses {
+		if class == crn {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether the user is in any section of the course
+func (u *User) Takes(subject, number string) bool {
+	var one int
+	err := QueuedQueryRow("SELECT 1 FROM user_courses JOIN courses ON courses.term_crn = user_courses.term_crn WHERE user_courses.user_id = ? AND courses.subject_code = ? AND courses.course_number = ? LIMIT 1;", u.ID, subject, number).Scan(&one)
+
+	return err == nil
+}
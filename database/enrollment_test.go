@@ -0,0 +1,55 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Users straight into the table, hashing passwords for this many would take a while
+func insertTestUsers(t *testing.T, n int) []User {
+	t.Helper()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tx.Rollback()
+
+	users := make([]User, n)
+
+	for i := range users {
+		result, err := tx.Exec(INSERT_USER_STATEMENT, fmt.Sprintf("user%d@example.edu", i), "Test", "User", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id, _ := result.LastInsertId()
+		users[i].ID = int(id)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	return users
+}
+
+func TestLoadCoursesForManyUsers(t *testing.T) {
+	OpenTestDatabase(t)
+	users := insertTestUsers(t, 2*MAX_IDS_PER_QUERY+1)
+
+	if err := QueuedExec("INSERT INTO user_courses (user_id, term_crn, added_at) SELECT id, '202510-' || id, 0 FROM users;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadCourses(users); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range users {
+		if len(user.Courses) != 1 || user.Courses[0] != fmt.Sprintf("202510-%d", user.ID) {
+			t.Fatalf("user %d has courses %v", user.ID, user.Courses)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package database
+
+import (
+	"time"
+)
+
+const (
+	EXPORT_PENDING    = "pending"
+	EXPORT_READY      = "ready"
+	EXPORT_FAILED     = "failed"
+	EXPORT_DOWNLOADED = "downloaded"
+)
+
+type DataExport struct {
+	UserID         int
+	Status, Format string
+	Size           int
+	Error          string
+	RequestedAt    time.Time
+	FinishedAt     *time.Time
+}
+
+// Everything but the data itself
+func GetDataExport(userID int) (*DataExport, error) {
+	var e DataExport
+	var requested int64
+	var finished *int64
+
+	err := QueuedQueryRow("SELECT user_id, status, format, COALESCE(LENGTH(data), 0), error, requested_at, finished_at FROM data_exports WHERE user_id = ?;", userID).
+		Scan(&e.UserID, &e.Status, &e.Format, &e.Size, &e.Error, &requested, &finished)
+	if err != nil {
+		return nil, err
+	}
+
+	e.RequestedAt = time.Unix(requested, 0)
+	e.FinishedAt = optionalTime(finished)
+
+	return &e, nil
+}
+
+// Replaces whatever export the user had before, links to the old one stop working
+func StartDataExport(userID int, format string) error {
+	if err := RevokeOneTimeTokens(userID, TOKEN_PURPOSE_DATA_EXPORT); err != nil {
+		return err
+	}
+
+	return QueuedExec("INSERT OR REPLACE INTO data_exports (user_id, status, format, requested_at) VALUES (?, ?, ?, ?);",
+		userID, EXPORT_PENDING, format, time.Now().Unix())
+}
+
+func FinishDataExport(userID int, data []byte) error {
+	return QueuedExec("UPDATE data_exports SET status = ?, data = ?, finished_at = ? WHERE user_id = ? AND status = ?;",
+		EXPORT_READY, data, time.Now().Unix(), userID, EXPORT_PENDING)
+}
+
+func FailDataExport(userID int, errorText string) error {
+	return QueuedExec("UPDATE data_exports SET status = ?, error = ?, finished_at = ? WHERE user_id = ? AND status = ?;",
+		EXPORT_FAILED, errorText, time.Now().Unix(), userID, EXPORT_PENDING)
+}
+
+// Hands over the finished export and forgets its data, it can only be downloaded once
+func TakeDataExport(userID int) (string, []byte, error) {
+	tx, err := QueuedBegin()
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer tx.Rollback()
+
+	var format string
+	var data []byte
+
+	if err := tx.QueryRow("SELECT format, data FROM data_exports WHERE user_id = ? AND status = ?;", userID, EXPORT_READY).Scan(&format, &data); err != nil {
+		return "", nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE data_exports SET status = ?, data = NULL WHERE user_id = ?;", EXPORT_DOWNLOADED, userID); err != nil {
+		return "", nil, err
+	}
+
+	return format, data, tx.Commit()
+}
+
+// Exports still pending when the server stopped will never finish, so at startup they're marked failed
+func FailInterruptedDataExports() error {
+	return QueuedExec("UPDATE data_exports SET status = ?, error = 'interrupted', finished_at = ? WHERE status = ?;",
+		EXPORT_FAILED, time.Now().Unix(), EXPORT_PENDING)
+}
+
+// Ready exports past their link's lifetime will never be downloaded, they're marked failed and lose their data
+func CleanUpDataExports(lifetime time.Duration) error {
+	return QueuedExec("UPDATE data_exports SET status = ?, error = 'expired', data = NULL WHERE status = ? AND finished_at < ?;",
+		EXPORT_FAILED, EXPORT_READY, time.Now().Add(-lifetime).Unix())
+}
+
+// Rows as column name to value, for handing straight to the exporter
+func exportRows(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := QueuedQuery(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+
+		for i, column := range columns {
+			// Text can come back as bytes, nothing exported here is binary
+			if bytes, ok := values[i].([]byte); ok {
+				row[column] = string(bytes)
+			} else {
+				row[column] = values[i]
+			}
+		}
+
+		list = append(list, row)
+	}
+
+	return list, rows.Err()
+}
+
+// What each section of an export is made of, each query is given the user's id as ?1
+var exportSections = []struct {
+	name, query string
+	single      bool
+}{
+	{"profile", "SELECT id, email, first_name, last_name, privilege, verified, major, graduation_year, pronouns, bio, contacts FROM users WHERE id = ?;", true},
+	{"privacy", "SELECT field, visibility FROM privacy_settings WHERE user_id = ? ORDER BY field;", false},
+	{"courses", `SELECT uc.term_crn, c.title, c.subject_code, c.course_number, c.section_number, uc.added_at
+        FROM user_courses uc LEFT JOIN courses c ON c.term_crn = uc.term_crn WHERE uc.user_id = ? ORDER BY uc.added_at;`, false},
+	{"passkeys", "SELECT name, created_at, last_used_at FROM passkeys WHERE user_id = ? ORDER BY id;", false},
+	{"two_factor", "SELECT enabled FROM totp WHERE user_id = ?;", true},
+	{"friends", `SELECT CASE WHEN requester_id = ?1 THEN addressee_id ELSE requester_id END AS user_id,
+        CASE WHEN requester_id = ?1 THEN 'outgoing' ELSE 'incoming' END AS direction, status, created_at, responded_at
+        FROM connections WHERE requester_id = ?1 OR addressee_id = ?1 ORDER BY id;`, false},
+	{"blocks", "SELECT blocked_id AS user_id, created_at FROM blocks WHERE blocker_id = ? ORDER BY created_at;", false},
+	{"conversations", `SELECT id, CASE WHEN user_low = ?1 THEN user_high ELSE user_low END AS with_user_id, created_at, last_message_at
+        FROM conversations WHERE user_low = ?1 OR user_high = ?1 ORDER BY id;`, false},
+	{"messages", `SELECT m.id, m.conversation_id, m.sender_id, m.body, m.created_at, m.read_at
+        FROM direct_messages m JOIN conversations c ON c.id = m.conversation_id
+        WHERE c.user_low = ?1 OR c.user_high = ?1 ORDER BY m.id;`, false},
+	{"chat_messages", "SELECT id, term_crn, body, created_at FROM chat_messages WHERE author_id = ? ORDER BY id;", false},
+	{"threads", "SELECT id, term_crn, title, body, created_at, edited_at, deleted_at FROM threads WHERE author_id = ? ORDER BY id;", false},
+	{"replies", "SELECT id, thread_id, body, created_at, edited_at, deleted_at FROM replies WHERE author_id = ? ORDER BY id;", false},
+	{"groups", `SELECT g.id, g.name, g.description, g.term_crn, g.subject_code, g.course_number, g.location, m.role, m.joined_at
+        FROM study_group_members m JOIN study_groups g ON g.id = m.group_id WHERE m.user_id = ? ORDER BY m.joined_at;`, false},
+	{"notifications", "SELECT id, kind, term_crn, message, data, created_at, read_at FROM notifications WHERE user_id = ? ORDER BY id;", false},
+	{"invites", "SELECT code, max_uses, uses, created_at, expires_at, revoked_at FROM invites WHERE created_by = ? ORDER BY id;", false},
+	{"webhooks", "SELECT id, url, events, global, created_at FROM webhooks WHERE owner_id = ? ORDER BY id;", false},
+}
+
+// Sections with other people in them, from the column holding their id to the one for their email.
+// The email is only filled in when they let the user see it
+var exportParties = map[string][2]string{
+	"friends":       {"user_id", "email"},
+	"blocks":        {"user_id", "email"},
+	"conversations": {"with_user_id", "with_email"},
+	"messages":      {"sender_id", "sender"},
+}
+
+// Everything stored about the user, by section. Secrets like password hashes and tokens are left out
+func ExportUserData(userID int) (map[string]interface{}, error) {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := make(map[string]interface{}, len(exportSections))
+	emails := make(map[int64]string)
+
+	for _, section := range exportSections {
+		rows, err := exportRows(section.query, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		if party, ok := exportParties[section.name]; ok {
+			if err := addPartyEmails(user, rows, party[0], party[1], emails); err != nil {
+				return nil, err
+			}
+		}
+
+		// Single row sections are an object, or null when there's nothing
+		if section.single {
+			if len(rows) == 0 {
+				sections[section.name] = nil
+			} else {
+				sections[section.name] = rows[0]
+			}
+
+			continue
+		}
+
+		sections[section.name] = rows
+	}
+
+	return sections, nil
+}
+
+// Emails are remembered across sections, an empty one means it's hidden
+func addPartyEmails(user *User, rows []map[string]interface{}, party, partyEmail string, emails map[int64]string) error {
+	for _, row := range rows {
+		id, ok := row[party].(int64)
+		if !ok {
+			continue
+		}
+
+		email, known := emails[id]
+
+		if !known {
+			other, err := GetUserByID(int(id))
+			if err != nil {
+				return err
+			}
+
+			if other.CanSee(user, PRIVACY_FIELD_EMAIL) {
+				email = other.Email
+			}
+
+			emails[id] = email
+		}
+
+		if email != "" {
+			row[partyEmail] = email
+		}
+	}
+
+	return nil
+}
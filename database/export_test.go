@@ -0,0 +1,114 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCleanUpLeavesPendingExportsAlone(t *testing.T) {
+	OpenTestDatabase(t)
+	pending := createTestUser(t, "pending@example.edu")
+	stale := createTestUser(t, "stale@example.edu")
+	fresh := createTestUser(t, "fresh@example.edu")
+
+	for _, user := range []*User{pending, stale, fresh} {
+		if err := StartDataExport(user.ID, "json"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, user := range []*User{stale, fresh} {
+		if err := FinishDataExport(user.ID, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := QueuedExec("UPDATE data_exports SET finished_at = ? WHERE user_id = ?;", time.Now().Add(-2*time.Hour).Unix(), stale.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CleanUpDataExports(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int]string{pending.ID: EXPORT_PENDING, stale.ID: EXPORT_FAILED, fresh.ID: EXPORT_READY}
+
+	for id, status := range want {
+		export, err := GetDataExport(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if export.Status != status {
+			t.Errorf("user %d: got %s, want %s", id, export.Status, status)
+		}
+	}
+
+	if err := FailInterruptedDataExports(); err != nil {
+		t.Fatal(err)
+	}
+
+	if export, _ := GetDataExport(pending.ID); export.Status != EXPORT_FAILED || export.Error != "interrupted" {
+		t.Fatalf("interrupted export is %s (%s)", export.Status, export.Error)
+	}
+}
+
+func TestExportHidesOtherPeoplesEmails(t *testing.T) {
+	OpenTestDatabase(t)
+	user := createTestUser(t, "exporter@example.edu")
+	hidden := createTestUser(t, "hidden@example.edu")
+	public := createTestUser(t, "public@example.edu")
+
+	if err := hidden.SetPrivacy(PRIVACY_FIELD_EMAIL, VISIBILITY_HIDDEN); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := public.SetPrivacy(PRIVACY_FIELD_EMAIL, VISIBILITY_PUBLIC); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, other := range []*User{hidden, public} {
+		if _, err := SendFriendRequest(user.ID, other.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conversation, err := ConversationBetween(user.ID, hidden.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SendDirectMessage(conversation.ID, hidden.ID, "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	sections, err := ExportUserData(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	friends := sections["friends"].([]map[string]interface{})
+
+	if len(friends) != 2 || friends[0]["user_id"] != int64(hidden.ID) || friends[1]["user_id"] != int64(public.ID) {
+		t.Fatalf("unexpected friends %v", friends)
+	}
+
+	if _, ok := friends[0]["email"]; ok {
+		t.Errorf("exported a hidden email: %v", friends[0])
+	}
+
+	if friends[1]["email"] != public.Email {
+		t.Errorf("left out a public email: %v", friends[1])
+	}
+
+	conversations := sections["conversations"].([]map[string]interface{})
+	messages := sections["messages"].([]map[string]interface{})
+
+	if len(conversations) != 1 || conversations[0]["with_user_id"] != int64(hidden.ID) || conversations[0]["with_email"] != nil {
+		t.Errorf("unexpected conversations %v", conversations)
+	}
+
+	if len(messages) != 1 || messages[0]["sender_id"] != int64(hidden.ID) || messages[0]["sender"] != nil {
+		t.Errorf("unexpected messages %v", messages)
+	}
+}
@@ -0,0 +1,206 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	CONNECTION_PENDING  = "pending"
+	CONNECTION_ACCEPTED = "accepted"
+)
+
+var ErrorAlreadyConnected error = fmt.Errorf("already friends or requested")
+var ErrorNoConnection error = fmt.Errorf("no such friend or request")
+
+type Connection struct {
+	ID, RequesterID, AddresseeID int
+	Status                       string
+	CreatedAt                    time.Time
+}
+
+func connectionBetween(a, b int) (*Connection, error) {
+	var c Connection
+	var created int64
+
+	err := QueuedQueryRow("SELECT id, requester_id, addressee_id, status, created_at FROM connections WHERE (requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?);", a, b, b, a).
+		Scan(&c.ID, &c.RequesterID, &c.AddresseeID, &c.Status, &created)
+	if err != nil {
+		return nil, err
+	}
+
+	c.CreatedAt = time.Unix(created, 0)
+
+	return &c, nil
+}
+
+// Asking someone who already asked you accepts their request instead. It all happens
+// in one transaction, so two people asking each other at once can't both end up pending
+func SendFriendRequest(from, to int) (string, error) {
+	tx, err := QueuedBegin()
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+
+	result, err := tx.Exec("UPDATE connections SET status = ?, responded_at = ? WHERE requester_id = ? AND addressee_id = ? AND status = ?;", CONNECTION_ACCEPTED, now, to, from, CONNECTION_PENDING)
+	if err != nil {
+		return "", err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if affected == 1 {
+		return CONNECTION_ACCEPTED, tx.Commit()
+	}
+
+	var status string
+
+	err = tx.QueryRow("SELECT status FROM connections WHERE (requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?);", from, to, to, from).Scan(&status)
+
+	switch {
+	case err == nil:
+		return status, ErrorAlreadyConnected
+	case err != sql.ErrNoRows:
+		return "", err
+	}
+
+	if _, err := tx.Exec("INSERT INTO connections (requester_id, addressee_id, status, created_at) VALUES (?, ?, ?, ?);", from, to, CONNECTION_PENDING, now); err != nil {
+		return "", err
+	}
+
+	return CONNECTION_PENDING, tx.Commit()
+}
+
+// Only the person who was asked can accept
+func AcceptFriendRequest(addressee, requester int) error {
+	result, err := QueuedExecResult("UPDATE connections SET status = ?, responded_at = ? WHERE requester_id = ? AND addressee_id = ? AND status = ?;", CONNECTION_ACCEPTED, time.Now().Unix(), requester, addressee, CONNECTION_PENDING)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		return ErrorNoConnection
+	}
+
+	return nil
+}
+
+// Declining just forgets the request, so it can be sent again later
+func DeclineFriendRequest(addressee, requester int) error {
+	result, err := QueuedExecResult("DELETE FROM connections WHERE requester_id = ? AND addressee_id = ? AND status = ?;", requester, addressee, CONNECTION_PENDING)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		return ErrorNoConnection
+	}
+
+	return nil
+}
+
+// Unfriends, or takes back a request that hasn't been answered
+func RemoveConnection(a, b int) error {
+	result, err := QueuedExecResult("DELETE FROM connections WHERE ((requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ? AND status = ?));", a, b, b, a, CONNECTION_ACCEPTED)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		return ErrorNoConnection
+	}
+
+	return nil
+}
+
+func AreFriends(a, b int) bool {
+	c, err := connectionBetween(a, b)
+	return err == nil && c.Status == CONNECTION_ACCEPTED
+}
+
+// The other side of every connection the user is part of with the given status,
+// outgoing picks requests the user sent rather than ones they received
+func connectedUsers(userID int, status string, outgoing bool) ([]User, error) {
+	query := `SELECT users.id, email, first_name, last_name, password, privilege, verified, major, graduation_year, pronouns, bio, contacts FROM users JOIN connections ON `
+
+	var rows *sql.Rows
+	var err error
+
+	switch {
+	case status == CONNECTION_ACCEPTED:
+		rows, err = QueuedQuery(query+`(connections.requester_id = ? AND connections.addressee_id = users.id) OR (connections.addressee_id = ? AND connections.requester_id = users.id) WHERE connections.status = ? ORDER BY first_name, last_name;`, userID, userID, status)
+	case outgoing:
+		rows, err = QueuedQuery(query+`connections.requester_id = ? AND connections.addressee_id = users.id WHERE connections.status = ? ORDER BY connections.created_at;`, userID, status)
+	default:
+		rows, err = QueuedQuery(query+`connections.addressee_id = ? AND connections.requester_id = users.id WHERE connections.status = ? ORDER BY connections.created_at;`, userID, status)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	users := make([]User, 0)
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, *u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows.Close()
+
+	if err := loadCourses(users); err != nil {
+		return nil, err
+	}
+
+	return users, loadPrivacy(users)
+}
+
+func Friends(userID int) ([]User, error) {
+	return connectedUsers(userID, CONNECTION_ACCEPTED, false)
+}
+
+func IncomingFriendRequests(userID int) ([]User, error) {
+	return connectedUsers(userID, CONNECTION_PENDING, false)
+}
+
+func OutgoingFriendRequests(userID int) ([]User, error) {
+	return connectedUsers(userID, CONNECTION_PENDING, true)
+}
+
+func FriendIDs(userID int) (map[int]bool, error) {
+	rows, err := QueuedQuery("SELECT CASE WHEN requester_id = ? THEN addressee_id ELSE requester_id END FROM connections WHERE (requester_id = ? OR addressee_id = ?) AND status = ?;", userID, userID, userID, CONNECTION_ACCEPTED)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ids := make(map[int]bool)
+
+	for rows.Next() {
+		var id int
+
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids[id] = true
+	}
+
+	return ids, rows.Err()
+}
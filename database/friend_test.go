@@ -0,0 +1,35 @@
+package database
+
+import "testing"
+
+func TestAskingBackAcceptsTheRequest(t *testing.T) {
+	OpenTestDatabase(t)
+	a := createTestUser(t, "a@example.edu")
+	b := createTestUser(t, "b@example.edu")
+
+	if status, err := SendFriendRequest(a.ID, b.ID); err != nil || status != CONNECTION_PENDING {
+		t.Fatalf("first request: got %q %v, want pending", status, err)
+	}
+
+	if status, err := SendFriendRequest(a.ID, b.ID); err != ErrorAlreadyConnected || status != CONNECTION_PENDING {
+		t.Fatalf("asking again: got %q %v, want pending and ErrorAlreadyConnected", status, err)
+	}
+
+	if status, err := SendFriendRequest(b.ID, a.ID); err != nil || status != CONNECTION_ACCEPTED {
+		t.Fatalf("asking back: got %q %v, want accepted", status, err)
+	}
+
+	if !AreFriends(a.ID, b.ID) {
+		t.Fatal("not friends after asking back")
+	}
+
+	var rows int
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM connections;").Scan(&rows); err != nil || rows != 1 {
+		t.Fatalf("got %d connections (%v), want 1", rows, err)
+	}
+
+	if status, err := SendFriendRequest(b.ID, a.ID); err != ErrorAlreadyConnected || status != CONNECTION_ACCEPTED {
+		t.Fatalf("asking friends: got %q %v, want accepted and ErrorAlreadyConnected", status, err)
+	}
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"strings"
+	"time"
+
+	"hacknhbackend.eparker.dev/util"
+)
+
+type Invite struct {
+	ID, CreatedBy, MaxUses, Uses int
+	Code                         string
+	CreatedAt                    time.Time
+	ExpiresAt, RevokedAt         *time.Time
+}
+
+func scanInvite(row scanner) (*Invite, error) {
+	var i Invite
+	var created int64
+	var expires, revoked *int64
+
+	if err := row.Scan(&i.ID, &i.Code, &i.CreatedBy, &i.MaxUses, &i.Uses, &created, &expires, &revoked); err != nil {
+		return nil, err
+	}
+
+	i.CreatedAt = time.Unix(created, 0)
+
+	if expires != nil {
+		t := time.Unix(*expires, 0)
+		i.ExpiresAt = &t
+	}
+
+	if revoked != nil {
+		t := time.Unix(*revoked, 0)
+		i.RevokedAt = &t
+	}
+
+	return &i, nil
+}
+
+// A lifetime of zero means the invite never expires
+func CreateInvite(createdBy, maxUses int, lifetime time.Duration) (*Invite, error) {
+	code, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// Short enough to type, still 64 bits
+	code = code[:16]
+
+	var expires *int64
+
+	if lifetime > 0 {
+		at := time.Now().Add(lifetime).Unix()
+		expires = &at
+	}
+
+	err = QueuedExec("INSERT INTO invites (code, created_by, max_uses, created_at, expires_at) VALUES (?, ?, ?, ?, ?);", code, createdBy, maxUses, time.Now().Unix(), expires)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanInvite(QueuedQueryRow("SELECT id, code, created_by, max_uses, uses, created_at, expires_at, revoked_at FROM invites WHERE code = ?;", code))
+}
+
+func AllInvites() ([]Invite, error) {
+	rows, err := QueuedQuery("SELECT id, code, created_by, max_uses, uses, created_at, expires_at, revoked_at FROM invites ORDER BY created_at DESC;")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	invites := make([]Invite, 0)
+
+	for rows.Next() {
+		i, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		invites = append(invites, *i)
+	}
+
+	return invites, nil
+}
+
+// Already used seats stay used, nobody new can redeem it
+func RevokeInvite(code string) (bool, error) {
+	result, err := QueuedExecResult("UPDATE invites SET revoked_at = ? WHERE code = ? AND revoked_at IS NULL;", time.Now().Unix(), code)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// Takes a seat in a single statement so two signups can't both get the last one
+func redeemInvite(code string) (bool, error) {
+	result, err := QueuedExecResult("UPDATE invites SET uses = uses + 1 WHERE code = ? AND revoked_at IS NULL AND uses < max_uses AND (expires_at IS NULL OR expires_at > ?);", code, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// Gives the seat back when the account couldn't be created after all
+func releaseInvite(code string) error {
+	return QueuedExec("UPDATE invites SET uses = uses - 1 WHERE code = ? AND uses > 0;", code)
+}
+
+// Whether the address can sign up without an invite
+func SignupDomainAllowed(email string) bool {
+	if util.Config.Signup.RequireInvite {
+		return false
+	}
+
+	if len(util.Config.Signup.AllowedDomains) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(email, "@")
+
+	if at == -1 {
+		return false
+	}
+
+	for _, domain := range util.Config.Signup.AllowedDomains {
+		if strings.EqualFold(email[at+1:], domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CreateUser with the signup restrictions applied, a valid invite gets around the domain list.
+// Passwords follow the same rules as a reset
+func Signup(email, first, last, password, invite string) (*User, int) {
+	if !ValidEmail(email) || !ValidPassword(password) {
+		return nil, CREATE_USER_ERROR_BadRequest
+	}
+
+	if _, err := GetUser(email); err == nil {
+		return nil, CREATE_USER_ERROR_IMUsed
+	}
+
+	if SignupDomainAllowed(email) {
+		return CreateUser(email, first, last, password)
+	}
+
+	if invite == "" {
+		return nil, CREATE_USER_ERROR_Forbidden
+	}
+
+	if redeemed, err := redeemInvite(invite); err != nil {
+		return nil, CREATE_USER_ERROR_InternalServerError
+	} else if !redeemed {
+		return nil, CREATE_USER_ERROR_Forbidden
+	}
+
+	user, statusCode := CreateUser(email, first, last, password)
+
+	if statusCode != CREATE_USER_SUCCESS {
+		releaseInvite(invite)
+	}
+
+	return user, statusCode
+}
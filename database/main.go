@@ -2,56 +2,205 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
+	"os"
 	"time"
 
 	"hacknhbackend.eparker.dev/util"
 	_ "modernc.org/sqlite"
 )
 
-const COURSES_STATEMENT = `CREATE TABLE IF NOT EXISTS courses (
-    term_crn TEXT PRIMARY KEY,
-    title TEXT NOT NULL,
-    subject_code TEXT NOT NULL,
-    course_number TEXT NOT NULL,
-	section_number TEXT NOT NULL,
-    description TEXT NOT NULL
-);`
+// The primary key covers lookups by user, the index covers lookups by course
+const USER_COURSES_STATEMENT = `CREATE TABLE IF NOT EXISTS user_courses (
+    user_id INTEGER NOT NULL,
+    term_crn TEXT NOT NULL,
+    added_at INTEGER NOT NULL,
+    PRIMARY KEY (user_id, term_crn),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS user_courses_term_crn ON user_courses (term_crn);`
+
+// Each pair of users has at most one connection, whichever way it was requested
+const CONNECTIONS_STATEMENT = `CREATE TABLE IF NOT EXISTS connections (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    requester_id INTEGER NOT NULL,
+    addressee_id INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    responded_at INTEGER,
+    UNIQUE (requester_id, addressee_id),
+    FOREIGN KEY (requester_id) REFERENCES users(id),
+    FOREIGN KEY (addressee_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS connections_addressee_id ON connections (addressee_id);`
 
-const INSTRUCTORS_STATEMENT = `CREATE TABLE IF NOT EXISTS instructors (
+// A group belongs to one section (term_crn) or to every section of a course (subject_code + course_number)
+const STUDY_GROUPS_STATEMENT = `CREATE TABLE IF NOT EXISTS study_groups (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    term_crn TEXT,
+    subject_code TEXT,
+    course_number TEXT,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL,
+    capacity INTEGER NOT NULL,
+    location TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS study_groups_term_crn ON study_groups (term_crn);
+CREATE INDEX IF NOT EXISTS study_groups_course ON study_groups (subject_code, course_number);`
+
+const STUDY_GROUP_MEMBERS_STATEMENT = `CREATE TABLE IF NOT EXISTS study_group_members (
+    group_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    role TEXT NOT NULL,
+    joined_at INTEGER NOT NULL,
+    PRIMARY KEY (group_id, user_id),
+    FOREIGN KEY (group_id) REFERENCES study_groups(id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS study_group_members_user_id ON study_group_members (user_id);`
+
+// Deleted posts are kept so moderators can see what was removed, deleted_by says whether it was the author
+const THREADS_STATEMENT = `CREATE TABLE IF NOT EXISTS threads (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    last_name TEXT NOT NULL,
-    first_name TEXT NOT NULL,
-    email TEXT NOT NULL,
     term_crn TEXT NOT NULL,
-    FOREIGN KEY (term_crn) REFERENCES courses(term_crn)
-);`
+    author_id INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    edited_at INTEGER,
+    last_activity_at INTEGER NOT NULL,
+    deleted_at INTEGER,
+    deleted_by INTEGER,
+    FOREIGN KEY (author_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS threads_term_crn ON threads (term_crn, last_activity_at);`
+
+const REPLIES_STATEMENT = `CREATE TABLE IF NOT EXISTS replies (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    thread_id INTEGER NOT NULL,
+    author_id INTEGER NOT NULL,
+    body TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    edited_at INTEGER,
+    deleted_at INTEGER,
+    deleted_by INTEGER,
+    FOREIGN KEY (thread_id) REFERENCES threads(id),
+    FOREIGN KEY (author_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS replies_thread_id ON replies (thread_id, created_at);`
 
-const MEETINGS_STATEMENT = `CREATE TABLE IF NOT EXISTS meetings (
+const CHAT_MESSAGES_STATEMENT = `CREATE TABLE IF NOT EXISTS chat_messages (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    days TEXT NOT NULL,
-    building TEXT NOT NULL,
-    room TEXT NOT NULL,
-    time TEXT NOT NULL,
     term_crn TEXT NOT NULL,
-    FOREIGN KEY (term_crn) REFERENCES courses(term_crn)
+    author_id INTEGER NOT NULL,
+    body TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (author_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS chat_messages_term_crn ON chat_messages (term_crn, id);`
+
+// Each pair of users has at most one conversation, stored with the lower id first
+const CONVERSATIONS_STATEMENT = `CREATE TABLE IF NOT EXISTS conversations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_low INTEGER NOT NULL,
+    user_high INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    last_message_at INTEGER NOT NULL,
+    UNIQUE (user_low, user_high),
+    FOREIGN KEY (user_low) REFERENCES users(id),
+    FOREIGN KEY (user_high) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS conversations_user_high ON conversations (user_high);`
+
+const DIRECT_MESSAGES_STATEMENT = `CREATE TABLE IF NOT EXISTS direct_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    conversation_id INTEGER NOT NULL,
+    sender_id INTEGER NOT NULL,
+    body TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    read_at INTEGER,
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+    FOREIGN KEY (sender_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS direct_messages_conversation_id ON direct_messages (conversation_id, id);`
+
+const BLOCKS_STATEMENT = `CREATE TABLE IF NOT EXISTS blocks (
+    blocker_id INTEGER NOT NULL,
+    blocked_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (blocker_id, blocked_id),
+    FOREIGN KEY (blocker_id) REFERENCES users(id),
+    FOREIGN KEY (blocked_id) REFERENCES users(id)
 );`
 
-const USERS_STATEMENT = `CREATE TABLE IF NOT EXISTS users (
+const NOTIFICATIONS_STATEMENT = `CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    term_crn TEXT,
+    message TEXT NOT NULL,
+    data TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    read_at INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS notifications_user_id ON notifications (user_id, id);`
+
+// Events is a comma separated list. Global hooks, set up by admins, hear about every course
+const WEBHOOKS_STATEMENT = `CREATE TABLE IF NOT EXISTS webhooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    owner_id INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT NOT NULL,
+    global INTEGER NOT NULL DEFAULT 0,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (owner_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS webhooks_owner_id ON webhooks (owner_id);`
+
+const WEBHOOK_DELIVERIES_STATEMENT = `CREATE TABLE IF NOT EXISTS webhook_deliveries (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    email TEXT NOT NULL,
-	first_name TEXT NOT NULL,
-	last_name TEXT NOT NULL,
-	password TEXT NOT NULL,
-	classes TEXT NOT NULL,
-	privilege INTEGER NOT NULL DEFAULT 0
+    webhook_id INTEGER NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at INTEGER,
+    response_code INTEGER,
+    error TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL,
+    finished_at INTEGER,
+    FOREIGN KEY (webhook_id) REFERENCES webhooks(id)
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);`
+
+// One export per user, requesting a new one replaces it. Data is dropped once downloaded
+const DATA_EXPORTS_STATEMENT = `CREATE TABLE IF NOT EXISTS data_exports (
+    user_id INTEGER PRIMARY KEY,
+    status TEXT NOT NULL,
+    format TEXT NOT NULL,
+    data BLOB,
+    error TEXT NOT NULL DEFAULT '',
+    requested_at INTEGER NOT NULL,
+    finished_at INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id)
 );`
 
+// Checking for a taken address before writing it leaves a gap another request can get through
+const USERS_EMAIL_INDEX_STATEMENT = `CREATE UNIQUE INDEX IF NOT EXISTS users_email ON users (email);`
+
 const INSERT_USER_STATEMENT = `INSERT INTO users (email, first_name, last_name, password, classes) VALUES (?, ?, ?, ?, ?);`
 const INSERT_INSTUCTOR_STATEMENT = `INSERT INTO instructors (last_name, first_name, email, term_crn) VALUES (?, ?, ?, ?);`
 const INSERT_MEETING_STATEMENT = `INSERT INTO meetings (days, building, room, time, term_crn) VALUES (?, ?, ?, ?, ?);`
 const INSERT_COURSE_STATEMENT = `INSERT INTO courses (term_crn, title, subject_code, course_number, section_number, description) VALUES (?, ?, ?, ?, ?, ?);`
 
-const SELECT_USER_STATEMENT = `SELECT id, email, first_name, last_name, password, classes, privilege FROM users WHERE email = ?;`
+const SELECT_USER_STATEMENT = `SELECT id, email, first_name, last_name, password, privilege, verified, major, graduation_year, pronouns, bio, contacts FROM users WHERE email = ?;`
+const SELECT_USER_BY_ID_STATEMENT = `SELECT id, email, first_name, last_name, password, privilege, verified, major, graduation_year, pronouns, bio, contacts FROM users WHERE id = ?;`
+const SELECT_USERS_STATEMENT = `SELECT id, email, first_name, last_name, password, privilege, verified, major, graduation_year, pronouns, bio, contacts FROM users;`
+const SELECT_USERS_IN_COURSE_STATEMENT = `SELECT users.id, email, first_name, last_name, password, privilege, verified, major, graduation_year, pronouns, bio, contacts FROM users JOIN user_courses ON user_courses.user_id = users.id WHERE user_courses.term_crn = ? ORDER BY user_courses.added_at;`
 const SELECT_COUSE_STATEMENT = `SELECT term_crn, title, subject_code, course_number, section_number, description FROM courses WHERE term_crn = ?;`
 const SELECT_INSTRUCTORS_STATEMENT = `SELECT id, last_name, first_name, email FROM instructors WHERE term_crn = ?;`
 const SELECT_MEETINGS_STATEMENT = `SELECT id, days, building, room, time FROM meetings WHERE term_crn = ?;`
@@ -78,30 +227,41 @@ func OpenDatabase() (*sql.DB, error) {
 	return db, err
 }
 
+func CloseDatabase() error {
+	return db.Close()
+}
+
+// Opens the database and brings the schema up to date, or refuses to
+// start when it isn't and migrations have to be run by hand
 func Init() {
-	db, err := OpenDatabase()
+	_, err := OpenDatabase()
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = db.Exec(USERS_STATEMENT)
-	if err != nil {
-		panic(err)
-	}
+	if util.Config.Database.AutoMigrate {
+		applied, err := Migrate()
+		if err != nil {
+			util.Log.Error(fmt.Sprintf("Error migrating the database: %v", err))
+			os.Exit(1)
+		}
 
-	_, err = db.Exec(COURSES_STATEMENT)
-	if err != nil {
-		panic(err)
+		if applied > 0 {
+			util.Log.Status(fmt.Sprintf("Applied %d migration(s), schema is at version %d", applied, LatestSchemaVersion()))
+		}
+
+		return
 	}
 
-	_, err = db.Exec(INSTRUCTORS_STATEMENT)
+	version, err := CheckSchemaVersion()
 	if err != nil {
-		panic(err)
+		util.Log.Error(err.Error())
+		os.Exit(1)
 	}
 
-	_, err = db.Exec(MEETINGS_STATEMENT)
-	if err != nil {
-		panic(err)
+	if version < LatestSchemaVersion() {
+		util.Log.Error(fmt.Sprintf("Database schema is at version %d, run \"migrate\" to bring it to %d", version, LatestSchemaVersion()))
+		os.Exit(1)
 	}
 }
 
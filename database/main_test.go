@@ -0,0 +1,14 @@
+package database
+
+import "testing"
+
+func createTestUser(t *testing.T, email string) *User {
+	t.Helper()
+
+	user, status := CreateUser(email, "Test", "User", "password1")
+	if status != CREATE_USER_SUCCESS {
+		t.Fatalf("creating %s: status %d", email, status)
+	}
+
+	return user
+}
@@ -0,0 +1,269 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+var ErrorNotBlocked error = fmt.Errorf("user isn't blocked")
+
+// OtherID and Unread are from the point of view of whoever asked for it
+type Conversation struct {
+	ID, OtherID, Unread   int
+	CreatedAt, ActivityAt time.Time
+	LastMessage           *DirectMessage
+}
+
+type DirectMessage struct {
+	ID, ConversationID, SenderID int
+	Body                         string
+	CreatedAt                    time.Time
+	ReadAt                       *time.Time
+}
+
+func orderedPair(a, b int) (int, int) {
+	if a < b {
+		return a, b
+	}
+
+	return b, a
+}
+
+const selectDirectMessages = `SELECT id, conversation_id, sender_id, body, created_at, read_at FROM direct_messages `
+
+func scanDirectMessage(row scanner) (*DirectMessage, error) {
+	var m DirectMessage
+	var created int64
+	var read *int64
+
+	if err := row.Scan(&m.ID, &m.ConversationID, &m.SenderID, &m.Body, &created, &read); err != nil {
+		return nil, err
+	}
+
+	m.CreatedAt = time.Unix(created, 0)
+	m.ReadAt = optionalTime(read)
+
+	return &m, nil
+}
+
+const selectConversations = `SELECT id, CASE WHEN user_low = ? THEN user_high ELSE user_low END, created_at, last_message_at,
+    (SELECT COUNT(*) FROM direct_messages WHERE conversation_id = conversations.id AND sender_id != ? AND read_at IS NULL) FROM conversations `
+
+func scanConversation(row scanner) (*Conversation, error) {
+	var c Conversation
+	var created, activity int64
+
+	if err := row.Scan(&c.ID, &c.OtherID, &created, &activity, &c.Unread); err != nil {
+		return nil, err
+	}
+
+	c.CreatedAt = time.Unix(created, 0)
+	c.ActivityAt = time.Unix(activity, 0)
+
+	return &c, nil
+}
+
+func (c *Conversation) loadLastMessage() error {
+	m, err := scanDirectMessage(QueuedQueryRow(selectDirectMessages+"WHERE conversation_id = ? ORDER BY id DESC LIMIT 1;", c.ID))
+
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	c.LastMessage = m
+
+	return nil
+}
+
+// Only the two people in it can fetch a conversation, anyone else gets sql.ErrNoRows
+func GetConversation(id, viewer int) (*Conversation, error) {
+	c, err := scanConversation(QueuedQueryRow(selectConversations+"WHERE id = ? AND (user_low = ? OR user_high = ?);", viewer, viewer, id, viewer, viewer))
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.loadLastMessage()
+}
+
+// The pair's conversation, started if they've never talked before
+func ConversationBetween(viewer, other int) (*Conversation, error) {
+	low, high := orderedPair(viewer, other)
+	now := time.Now().Unix()
+
+	if err := QueuedExec("INSERT OR IGNORE INTO conversations (user_low, user_high, created_at, last_message_at) VALUES (?, ?, ?, ?);", low, high, now, now); err != nil {
+		return nil, err
+	}
+
+	c, err := scanConversation(QueuedQueryRow(selectConversations+"WHERE user_low = ? AND user_high = ?;", viewer, viewer, low, high))
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.loadLastMessage()
+}
+
+// Every conversation with at least one message, most recent first
+func UserConversations(userID int) ([]Conversation, error) {
+	rows, err := QueuedQuery(selectConversations+"WHERE (user_low = ? OR user_high = ?) AND EXISTS (SELECT 1 FROM direct_messages WHERE conversation_id = conversations.id) ORDER BY last_message_at DESC, id DESC;",
+		userID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	conversations := make([]Conversation, 0)
+
+	for rows.Next() {
+		c, err := scanConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		conversations = append(conversations, *c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows.Close()
+
+	for i := range conversations {
+		if err := conversations[i].loadLastMessage(); err != nil {
+			return nil, err
+		}
+	}
+
+	return conversations, nil
+}
+
+func SendDirectMessage(conversationID, senderID int, body string) (*DirectMessage, error) {
+	tx, err := QueuedBegin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	result, err := tx.Exec("INSERT INTO direct_messages (conversation_id, sender_id, body, created_at) VALUES (?, ?, ?, ?);", conversationID, senderID, body, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE conversations SET last_message_at = ? WHERE id = ?;", now.Unix(), conversationID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &DirectMessage{ID: int(id), ConversationID: conversationID, SenderID: senderID, Body: body, CreatedAt: now}, nil
+}
+
+// A page of the conversation, newest first
+func ConversationMessages(conversationID, limit, offset int) ([]DirectMessage, error) {
+	rows, err := QueuedQuery(selectDirectMessages+"WHERE conversation_id = ? ORDER BY id DESC LIMIT ? OFFSET ?;", conversationID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	messages := make([]DirectMessage, 0)
+
+	for rows.Next() {
+		m, err := scanDirectMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, *m)
+	}
+
+	return messages, rows.Err()
+}
+
+// Marks everything the other person sent as read, returning how many were unread
+func MarkConversationRead(conversationID, reader int) (int, error) {
+	result, err := QueuedExecResult("UPDATE direct_messages SET read_at = ? WHERE conversation_id = ? AND sender_id != ? AND read_at IS NULL;", time.Now().Unix(), conversationID, reader)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	return int(affected), err
+}
+
+// Blocking someone who's already blocked is fine
+func BlockUser(blocker, blocked int) error {
+	return QueuedExec("INSERT OR IGNORE INTO blocks (blocker_id, blocked_id, created_at) VALUES (?, ?, ?);", blocker, blocked, time.Now().Unix())
+}
+
+func UnblockUser(blocker, blocked int) error {
+	result, err := QueuedExecResult("DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?;", blocker, blocked)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		return ErrorNotBlocked
+	}
+
+	return nil
+}
+
+// Whether either of them has blocked the other
+func EitherBlocked(a, b int) bool {
+	var count int
+
+	err := QueuedQueryRow("SELECT COUNT(*) FROM blocks WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?);", a, b, b, a).Scan(&count)
+
+	// Failing closed, a block that can't be checked still counts
+	return err != nil || count > 0
+}
+
+func BlockedUsers(userID int) ([]User, error) {
+	rows, err := QueuedQuery(`SELECT users.id, email, first_name, last_name, password, privilege, verified, major, graduation_year, pronouns, bio, contacts FROM users
+    JOIN blocks ON blocks.blocked_id = users.id WHERE blocks.blocker_id = ? ORDER BY blocks.created_at;`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	users := make([]User, 0)
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, *u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows.Close()
+
+	if err := loadCourses(users); err != nil {
+		return nil, err
+	}
+
+	return users, loadPrivacy(users)
+}
@@ -0,0 +1,390 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**
+ * Numbered schema migrations. Each one runs in its own
+ * transaction together with the row recording it, so a
+ * failure leaves the database at the previous version.
+ * Append new migrations to the end, never edit or
+ * reorder ones that have shipped
+ */
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+// Run the statements in order
+func statements(list ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range list {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+var migrations = []Migration{
+	{1, "baseline", func(tx *sql.Tx) error {
+		// Databases from before migrations already have some of this
+		err := statements(BASELINE_SCHEMA)(tx)
+		if err != nil {
+			return err
+		}
+
+		found, err := hasColumn(tx, "users", "verified")
+		if err != nil || found {
+			return err
+		}
+
+		if _, err := tx.Exec("ALTER TABLE users ADD COLUMN verified INTEGER NOT NULL DEFAULT 0;"); err != nil {
+			return err
+		}
+
+		// Accounts from before verification existed were never sent a link, don't lock them out
+		_, err = tx.Exec("UPDATE users SET verified = 1;")
+		return err
+	}},
+	{2, "user_courses", func(tx *sql.Tx) error {
+		if err := statements(USER_COURSES_STATEMENT)(tx); err != nil {
+			return err
+		}
+
+		return migrateClassesColumn(tx)
+	}},
+	{3, "connections", statements(CONNECTIONS_STATEMENT)},
+	{4, "study_groups", statements(STUDY_GROUPS_STATEMENT, STUDY_GROUP_MEMBERS_STATEMENT)},
+	{5, "discussions", statements(THREADS_STATEMENT, REPLIES_STATEMENT)},
+	{6, "chat_messages", statements(CHAT_MESSAGES_STATEMENT)},
+	{7, "direct_messages", statements(CONVERSATIONS_STATEMENT, DIRECT_MESSAGES_STATEMENT, BLOCKS_STATEMENT)},
+	{8, "notifications", statements(NOTIFICATIONS_STATEMENT)},
+	{9, "webhooks", statements(WEBHOOKS_STATEMENT, WEBHOOK_DELIVERIES_STATEMENT)},
+	{10, "data_exports", statements(DATA_EXPORTS_STATEMENT)},
+	{11, "account_deletion", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "users", "delete_at", "INTEGER")
+	}},
+	{12, "profile_fields", func(tx *sql.Tx) error {
+		columns := [][2]string{
+			{"major", "TEXT NOT NULL DEFAULT ''"},
+			{"graduation_year", "INTEGER NOT NULL DEFAULT 0"},
+			{"pronouns", "TEXT NOT NULL DEFAULT ''"},
+			{"bio", "TEXT NOT NULL DEFAULT ''"},
+			{"contacts", "TEXT NOT NULL DEFAULT '{}'"},
+		}
+
+		for _, column := range columns {
+			if err := addColumnIfMissing(tx, "users", column[0], column[1]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}},
+	{13, "unique_emails", func(tx *sql.Tx) error {
+		duplicates, err := duplicateEmails(tx)
+		if err != nil {
+			return err
+		}
+
+		// Which account an address belongs to isn't something to guess at
+		if len(duplicates) > 0 {
+			return fmt.Errorf("more than one account uses %s, merge or rename them and migrate again", strings.Join(duplicates, ", "))
+		}
+
+		_, err = tx.Exec(USERS_EMAIL_INDEX_STATEMENT)
+		return err
+	}},
+}
+
+func duplicateEmails(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query("SELECT email FROM users GROUP BY email HAVING COUNT(*) > 1 ORDER BY email;")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	emails := make([]string, 0)
+
+	for rows.Next() {
+		var email string
+
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, email)
+	}
+
+	return emails, rows.Err()
+}
+
+/**
+ * The schema as it was when migrations were introduced, frozen here so
+ * migration 1 always builds the same tables. Later changes to these
+ * tables belong in new migrations, not in this copy
+ */
+const BASELINE_SCHEMA = `CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    email TEXT NOT NULL,
+	first_name TEXT NOT NULL,
+	last_name TEXT NOT NULL,
+	password TEXT NOT NULL,
+	classes TEXT NOT NULL,
+	privilege INTEGER NOT NULL DEFAULT 0,
+	verified INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS courses (
+    term_crn TEXT PRIMARY KEY,
+    title TEXT NOT NULL,
+    subject_code TEXT NOT NULL,
+    course_number TEXT NOT NULL,
+	section_number TEXT NOT NULL,
+    description TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS instructors (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    last_name TEXT NOT NULL,
+    first_name TEXT NOT NULL,
+    email TEXT NOT NULL,
+    term_crn TEXT NOT NULL,
+    FOREIGN KEY (term_crn) REFERENCES courses(term_crn)
+);
+
+CREATE TABLE IF NOT EXISTS meetings (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    days TEXT NOT NULL,
+    building TEXT NOT NULL,
+    room TEXT NOT NULL,
+    time TEXT NOT NULL,
+    term_crn TEXT NOT NULL,
+    FOREIGN KEY (term_crn) REFERENCES courses(term_crn)
+);
+
+CREATE TABLE IF NOT EXISTS one_time_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    purpose TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    email TEXT NOT NULL,
+    expires_at INTEGER NOT NULL,
+    used_at INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS totp (
+    user_id INTEGER PRIMARY KEY,
+    secret TEXT NOT NULL,
+    enabled INTEGER NOT NULL DEFAULT 0,
+    last_step INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS passkeys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    credential_id TEXT NOT NULL UNIQUE,
+    public_key BLOB NOT NULL,
+    sign_count INTEGER NOT NULL DEFAULT 0,
+    name TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    last_used_at INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS invites (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    code TEXT NOT NULL UNIQUE,
+    created_by INTEGER NOT NULL,
+    max_uses INTEGER NOT NULL,
+    uses INTEGER NOT NULL DEFAULT 0,
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER,
+    revoked_at INTEGER,
+    FOREIGN KEY (created_by) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS privacy_settings (
+    user_id INTEGER NOT NULL,
+    field TEXT NOT NULL,
+    visibility INTEGER NOT NULL,
+    PRIMARY KEY (user_id, field),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);`
+
+const SCHEMA_MIGRATIONS_STATEMENT = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at INTEGER NOT NULL
+);`
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func SchemaVersion() (int, error) {
+	if _, err := db.Exec(SCHEMA_MIGRATIONS_STATEMENT); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations;").Scan(&version)
+
+	return version, err
+}
+
+// Errors out when the database was migrated by a newer build than this one
+func CheckSchemaVersion() (int, error) {
+	version, err := SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	if version > LatestSchemaVersion() {
+		return version, fmt.Errorf("database schema is at version %d but this build only knows up to %d, refusing to touch it", version, LatestSchemaVersion())
+	}
+
+	return version, nil
+}
+
+func Migrations() ([]MigrationStatus, error) {
+	if _, err := SchemaVersion(); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time)
+
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations;")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var at int64
+
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+
+		applied[version] = time.Unix(at, 0)
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+
+	for i, migration := range migrations {
+		status[i].Migration = migration
+
+		if at, ok := applied[migration.Version]; ok {
+			status[i].AppliedAt = &at
+		}
+	}
+
+	return status, rows.Err()
+}
+
+// Applies every pending migration in order and returns how many ran
+func Migrate() (int, error) {
+	version, err := CheckSchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		if err := applyMigration(migration); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+
+		applied++
+	}
+
+	return applied, nil
+}
+
+func applyMigration(migration Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := migration.Up(tx); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?);", migration.Version, migration.Name, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CREATE TABLE IF NOT EXISTS won't touch existing tables, so columns
+// added before migrations existed have to be checked for by hand
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?);", table)
+	if err != nil {
+		return false, err
+	}
+
+	defer rows.Close()
+
+	found := false
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+
+		if name == column {
+			found = true
+		}
+	}
+
+	return found, rows.Err()
+}
+
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	found, err := hasColumn(tx, table, column)
+	if err != nil || found {
+		return err
+	}
+
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition + ";")
+	return err
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"hacknhbackend.eparker.dev/events"
+)
+
+const (
+	NOTIFICATION_COURSE_MOVED     = "course_moved"
+	NOTIFICATION_COURSE_RETIMED   = "course_retimed"
+	NOTIFICATION_COURSE_RESTAFFED = "course_restaffed"
+	NOTIFICATION_COURSE_DELETED   = "course_deleted"
+)
+
+// The most notifications that can be marked read by id at once
+const MAX_MARK_READ = 100
+
+var ErrorTooManyNotifications error = fmt.Errorf("too many notifications")
+
+// Data is whatever details go with the kind, as JSON
+type Notification struct {
+	ID, UserID         int
+	Kind, CRN, Message string
+	Data               json.RawMessage
+	CreatedAt          time.Time
+	ReadAt             *time.Time
+}
+
+const selectNotifications = `SELECT id, user_id, kind, COALESCE(term_crn, ''), message, data, created_at, read_at FROM notifications `
+
+func scanNotification(row scanner) (*Notification, error) {
+	var n Notification
+	var data string
+	var created int64
+	var read *int64
+
+	if err := row.Scan(&n.ID, &n.UserID, &n.Kind, &n.CRN, &n.Message, &data, &created, &read); err != nil {
+		return nil, err
+	}
+
+	n.Data = json.RawMessage(data)
+	n.CreatedAt = time.Unix(created, 0)
+	n.ReadAt = optionalTime(read)
+
+	return &n, nil
+}
+
+func (n *Notification) JSON() []byte {
+	var read interface{}
+
+	if n.ReadAt != nil {
+		read = n.ReadAt.Unix()
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{
+		"id":      n.ID,
+		"kind":    n.Kind,
+		"crn":     n.CRN,
+		"message": n.Message,
+		"data":    n.Data,
+		"created": n.CreatedAt.Unix(),
+		"read":    read,
+	})
+
+	return b
+}
+
+// Sends the same notification to everyone enrolled in the section, returning how many got it.
+// Anyone listening for events hears about it straight away
+func NotifyCourse(crn, kind, message string, data interface{}) (int, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := QueuedQuery(`INSERT INTO notifications (user_id, kind, term_crn, message, data, created_at)
+    SELECT user_id, ?, ?, ?, ?, ? FROM user_courses WHERE term_crn = ?
+    RETURNING id, user_id, kind, COALESCE(term_crn, ''), message, data, created_at, read_at;`, kind, crn, message, string(encoded), time.Now().Unix(), crn)
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	notifications := make([]Notification, 0)
+
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return 0, err
+		}
+
+		notifications = append(notifications, *n)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i := range notifications {
+		events.Publish(notifications[i].UserID, events.NOTIFICATION, json.RawMessage(notifications[i].JSON()))
+	}
+
+	return len(notifications), nil
+}
+
+// A page of the user's notifications, newest first, with how many there are and how many are unread
+func UserNotifications(userID int, unreadOnly bool, limit, offset int) ([]Notification, int, int, error) {
+	filter := "WHERE user_id = ?"
+
+	if unreadOnly {
+		filter += " AND read_at IS NULL"
+	}
+
+	var total, unread int
+
+	if err := QueuedQueryRow("SELECT COUNT(*), COUNT(*) FILTER (WHERE read_at IS NULL) FROM notifications "+filter+";", userID).Scan(&total, &unread); err != nil {
+		return nil, 0, 0, err
+	}
+
+	rows, err := QueuedQuery(selectNotifications+filter+" ORDER BY id DESC LIMIT ? OFFSET ?;", userID, limit, offset)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	defer rows.Close()
+
+	notifications := make([]Notification, 0)
+
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		notifications = append(notifications, *n)
+	}
+
+	return notifications, total, unread, rows.Err()
+}
+
+// Marks the given notifications as read, or all of them when ids is empty
+func MarkNotificationsRead(userID int, ids []int) (int, error) {
+	if len(ids) > MAX_MARK_READ {
+		return 0, ErrorTooManyNotifications
+	}
+
+	query := "UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL"
+	args := []interface{}{time.Now().Unix(), userID}
+
+	if len(ids) > 0 {
+		query += " AND id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+
+	result, err := QueuedExecResult(query+";", args...)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	return int(affected), err
+}
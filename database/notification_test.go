@@ -0,0 +1,16 @@
+package database
+
+import "testing"
+
+func TestMarkNotificationsReadIsCapped(t *testing.T) {
+	OpenTestDatabase(t)
+	user := createTestUser(t, "reader@example.edu")
+
+	if _, err := MarkNotificationsRead(user.ID, make([]int, MAX_MARK_READ+1)); err != ErrorTooManyNotifications {
+		t.Fatalf("got %v, want ErrorTooManyNotifications", err)
+	}
+
+	if _, err := MarkNotificationsRead(user.ID, make([]int, MAX_MARK_READ)); err != nil {
+		t.Fatal(err)
+	}
+}
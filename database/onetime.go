@@ -0,0 +1,80 @@
+package database
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// Purposes a one-time token can be issued for
+const (
+	TOKEN_PURPOSE_PASSWORD_RESET     = "password_reset"
+	TOKEN_PURPOSE_EMAIL_VERIFICATION = "email_verification"
+	TOKEN_PURPOSE_MAGIC_LOGIN        = "magic_login"
+	TOKEN_PURPOSE_DATA_EXPORT        = "data_export"
+)
+
+type OneTimeToken struct {
+	ID, UserID     int
+	Purpose, Email string
+	ExpiresAt      time.Time
+}
+
+func randomToken() (string, error) {
+	bytes := make([]byte, 32)
+
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", bytes), nil
+}
+
+// Issues a new token and returns the plain value, only its hash is stored
+func CreateOneTimeToken(userID int, purpose, email string, lifetime time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = QueuedExec("INSERT INTO one_time_tokens (user_id, purpose, token_hash, email, expires_at) VALUES (?, ?, ?, ?, ?);", userID, purpose, HashToken(token), email, time.Now().Add(lifetime).Unix())
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Marks the token as used and returns it, a token can only be consumed once
+func ConsumeOneTimeToken(purpose, token string) (*OneTimeToken, error) {
+	row := QueuedQueryRow("SELECT id, user_id, purpose, email, expires_at FROM one_time_tokens WHERE token_hash = ? AND purpose = ? AND used_at IS NULL;", HashToken(token), purpose)
+
+	var t OneTimeToken
+	var expires int64
+	if err := row.Scan(&t.ID, &t.UserID, &t.Purpose, &t.Email, &expires); err != nil {
+		return nil, ErrorInvalidToken
+	}
+
+	t.ExpiresAt = time.Unix(expires, 0)
+
+	if time.Now().After(t.ExpiresAt) {
+		return nil, ErrorInvalidToken
+	}
+
+	result, err := QueuedExecResult("UPDATE one_time_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL;", time.Now().Unix(), t.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Someone else consumed it between the select and the update
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		return nil, ErrorInvalidToken
+	}
+
+	return &t, nil
+}
+
+// Throws away every outstanding token a user has for the purpose
+func RevokeOneTimeTokens(userID int, purpose string) error {
+	return QueuedExec("DELETE FROM one_time_tokens WHERE user_id = ? AND purpose = ?;", userID, purpose)
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOneTimeTokenIsConsumedOnce(t *testing.T) {
+	OpenTestDatabase(t)
+	user := createTestUser(t, "reset@example.edu")
+
+	token, err := CreateOneTimeToken(user.ID, TOKEN_PURPOSE_PASSWORD_RESET, user.Email, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumed, err := ConsumeOneTimeToken(TOKEN_PURPOSE_PASSWORD_RESET, token)
+	if err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+
+	if consumed.UserID != user.ID || consumed.Email != user.Email {
+		t.Fatalf("token belongs to %d %s, want %d %s", consumed.UserID, consumed.Email, user.ID, user.Email)
+	}
+
+	if _, err := ConsumeOneTimeToken(TOKEN_PURPOSE_PASSWORD_RESET, token); err != ErrorInvalidToken {
+		t.Fatalf("second use: got %v, want ErrorInvalidToken", err)
+	}
+}
+
+func TestOneTimeTokenChecksPurposeAndExpiry(t *testing.T) {
+	OpenTestDatabase(t)
+	user := createTestUser(t, "expiry@example.edu")
+
+	token, err := CreateOneTimeToken(user.ID, TOKEN_PURPOSE_PASSWORD_RESET, user.Email, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ConsumeOneTimeToken(TOKEN_PURPOSE_EMAIL_VERIFICATION, token); err != ErrorInvalidToken {
+		t.Fatalf("wrong purpose: got %v, want ErrorInvalidToken", err)
+	}
+
+	expired, err := CreateOneTimeToken(user.ID, TOKEN_PURPOSE_PASSWORD_RESET, user.Email, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ConsumeOneTimeToken(TOKEN_PURPOSE_PASSWORD_RESET, expired); err != ErrorInvalidToken {
+		t.Fatalf("expired: got %v, want ErrorInvalidToken", err)
+	}
+
+	if _, err := ConsumeOneTimeToken(TOKEN_PURPOSE_PASSWORD_RESET, "not-a-token"); err != ErrorInvalidToken {
+		t.Fatalf("unknown: got %v, want ErrorInvalidToken", err)
+	}
+}
+
+func TestRevokedTokensStopWorking(t *testing.T) {
+	OpenTestDatabase(t)
+	user := createTestUser(t, "revoke@example.edu")
+
+	token, err := CreateOneTimeToken(user.ID, TOKEN_PURPOSE_PASSWORD_RESET, user.Email, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RevokeOneTimeTokens(user.ID, TOKEN_PURPOSE_PASSWORD_RESET); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ConsumeOneTimeToken(TOKEN_PURPOSE_PASSWORD_RESET, token); err != ErrorInvalidToken {
+		t.Fatalf("got %v, want ErrorInvalidToken", err)
+	}
+}
+
+func TestSignupRejectsShortPasswords(t *testing.T) {
+	OpenTestDatabase(t)
+
+	if _, status := Signup("short@example.edu", "Short", "Password", "1234567", ""); status != CREATE_USER_ERROR_BadRequest {
+		t.Fatalf("got status %d, want CREATE_USER_ERROR_BadRequest", status)
+	}
+
+	if _, status := Signup("long@example.edu", "Long", "Password", "password1", ""); status != CREATE_USER_SUCCESS {
+		t.Fatalf("got status %d, want CREATE_USER_SUCCESS", status)
+	}
+}
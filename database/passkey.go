@@ -0,0 +1,81 @@
+package database
+
+import (
+	"time"
+)
+
+type Passkey struct {
+	ID, UserID   int
+	CredentialID string
+	PublicKey    []byte
+	SignCount    uint32
+	Name         string
+	CreatedAt    time.Time
+	LastUsedAt   *time.Time
+}
+
+func scanPasskey(row scanner) (*Passkey, error) {
+	var p Passkey
+	var created int64
+	var lastUsed *int64
+
+	if err := row.Scan(&p.ID, &p.UserID, &p.CredentialID, &p.PublicKey, &p.SignCount, &p.Name, &created, &lastUsed); err != nil {
+		return nil, err
+	}
+
+	p.CreatedAt = time.Unix(created, 0)
+
+	if lastUsed != nil {
+		t := time.Unix(*lastUsed, 0)
+		p.LastUsedAt = &t
+	}
+
+	return &p, nil
+}
+
+func AddPasskey(userID int, credentialID string, publicKey []byte, signCount uint32, name string) error {
+	return QueuedExec("INSERT INTO passkeys (user_id, credential_id, public_key, sign_count, name, created_at) VALUES (?, ?, ?, ?, ?, ?);", userID, credentialID, publicKey, signCount, name, time.Now().Unix())
+}
+
+func GetPasskey(credentialID string) (*Passkey, error) {
+	return scanPasskey(QueuedQueryRow("SELECT id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at FROM passkeys WHERE credential_id = ?;", credentialID))
+}
+
+func UserPasskeys(userID int) ([]Passkey, error) {
+	rows, err := QueuedQuery("SELECT id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at FROM passkeys WHERE user_id = ? ORDER BY created_at;", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	passkeys := make([]Passkey, 0)
+
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		passkeys = append(passkeys, *p)
+	}
+
+	return passkeys, nil
+}
+
+func (p *Passkey) Used(signCount uint32) error {
+	p.SignCount = signCount
+
+	return QueuedExec("UPDATE passkeys SET sign_count = ?, last_used_at = ? WHERE id = ?;", signCount, time.Now().Unix(), p.ID)
+}
+
+// Users can only remove their own passkeys
+func DeletePasskey(userID int, credentialID string) (bool, error) {
+	result, err := QueuedExecResult("DELETE FROM passkeys WHERE user_id = ? AND credential_id = ?;", userID, credentialID)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
@@ -0,0 +1,246 @@
+package database
+
+import "encoding/json"
+
+// Who gets to see a profile field. These are stored, so new levels go on the end
+type Visibility int
+
+const (
+	VISIBILITY_PUBLIC     Visibility = 0
+	VISIBILITY_CLASSMATES Visibility = 1
+	VISIBILITY_HIDDEN     Visibility = 2
+	VISIBILITY_FRIENDS    Visibility = 3
+)
+
+var VisibilityNames = map[Visibility]string{
+	VISIBILITY_PUBLIC:     "public",
+	VISIBILITY_CLASSMATES: "classmates",
+	VISIBILITY_FRIENDS:    "friends",
+	VISIBILITY_HIDDEN:     "hidden",
+}
+
+func ParseVisibility(name string) (Visibility, bool) {
+	for visibility, visibilityName := range VisibilityNames {
+		if visibilityName == name {
+			return visibility, true
+		}
+	}
+
+	return VISIBILITY_HIDDEN, false
+}
+
+func (v Visibility) MarshalJSON() ([]byte, error) {
+	return json.Marshal(VisibilityNames[v])
+}
+
+// Fields a user can set the visibility of
+const (
+	PRIVACY_FIELD_EMAIL   = "email"
+	PRIVACY_FIELD_NAME    = "name"
+	PRIVACY_FIELD_COURSES = "courses"
+
+	PRIVACY_FIELD_MAJOR           = "major"
+	PRIVACY_FIELD_GRADUATION_YEAR = "graduationYear"
+	PRIVACY_FIELD_PRONOUNS        = "pronouns"
+	PRIVACY_FIELD_BIO             = "bio"
+	PRIVACY_FIELD_CONTACTS        = "contacts"
+)
+
+// Only classmates until the user says otherwise, contact handles only friends
+var DefaultPrivacy = map[string]Visibility{
+	PRIVACY_FIELD_EMAIL:   VISIBILITY_CLASSMATES,
+	PRIVACY_FIELD_NAME:    VISIBILITY_CLASSMATES,
+	PRIVACY_FIELD_COURSES: VISIBILITY_CLASSMATES,
+
+	PRIVACY_FIELD_MAJOR:           VISIBILITY_CLASSMATES,
+	PRIVACY_FIELD_GRADUATION_YEAR: VISIBILITY_CLASSMATES,
+	PRIVACY_FIELD_PRONOUNS:        VISIBILITY_CLASSMATES,
+	PRIVACY_FIELD_BIO:             VISIBILITY_CLASSMATES,
+	PRIVACY_FIELD_CONTACTS:        VISIBILITY_FRIENDS,
+}
+
+type Privacy map[string]Visibility
+
+func (p Privacy) Of(field string) Visibility {
+	if visibility, ok := p[field]; ok {
+		return visibility
+	}
+
+	return DefaultPrivacy[field]
+}
+
+// Settings the user hasn't touched come back as their defaults
+func (u *User) Privacy() (Privacy, error) {
+	if u.privacy != nil {
+		return u.privacy, nil
+	}
+
+	rows, err := QueuedQuery("SELECT field, visibility FROM privacy_settings WHERE user_id = ?;", u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	privacy := make(Privacy)
+
+	for field, visibility := range DefaultPrivacy {
+		privacy[field] = visibility
+	}
+
+	for rows.Next() {
+		var field string
+		var visibility Visibility
+
+		if err := rows.Scan(&field, &visibility); err != nil {
+			return nil, err
+		}
+
+		if _, ok := DefaultPrivacy[field]; ok {
+			privacy[field] = visibility
+		}
+	}
+
+	u.privacy = privacy
+
+	return privacy, nil
+}
+
+func (u *User) SetPrivacy(field string, visibility Visibility) error {
+	if _, ok := DefaultPrivacy[field]; !ok {
+		return ErrorUnknownField
+	}
+
+	err := QueuedExec("INSERT INTO privacy_settings (user_id, field, visibility) VALUES (?, ?, ?) ON CONFLICT (user_id, field) DO UPDATE SET visibility = excluded.visibility;", u.ID, field, visibility)
+	if err != nil {
+		return err
+	}
+
+	if u.privacy != nil {
+		u.privacy[field] = visibility
+	}
+
+	return nil
+}
+
+func (u *User) SharesCourseWith(other *User) bool {
+	for _, mine := range u.Courses {
+		for _, theirs := range other.Courses {
+			if mine == theirs {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Whether the viewer can see the field, settings that fail to load count as hidden.
+// Friends see everything classmates do. nil is someone who isn't logged in
+func (u *User) CanSee(viewer *User, field string) bool {
+	return u.audience(viewer).sees(field)
+}
+
+// Who the viewer is to u, worked out once and shared by every field checked.
+// Friendship costs a query, so it's only looked up when a setting needs it.
+// Viewers who aren't logged in or verified only ever see public fields
+type audience struct {
+	owner, viewer                     *User
+	everything, classmate             bool
+	friendChecked, friend, unverified bool
+}
+
+func (u *User) audience(viewer *User) *audience {
+	a := &audience{owner: u, viewer: viewer, unverified: viewer == nil || !viewer.Verified}
+
+	if viewer != nil && (viewer.ID == u.ID || viewer.Can(PERMISSION_VIEW_USERS)) {
+		a.everything = true
+	} else if !a.unverified {
+		a.classmate = u.SharesCourseWith(viewer)
+	}
+
+	return a
+}
+
+func (a *audience) isFriend() bool {
+	if !a.friendChecked {
+		a.friend = AreFriends(a.owner.ID, a.viewer.ID)
+		a.friendChecked = true
+	}
+
+	return a.friend
+}
+
+func (a *audience) sees(field string) bool {
+	if a.everything {
+		return true
+	}
+
+	privacy, err := a.owner.Privacy()
+	if err != nil {
+		return false
+	}
+
+	switch privacy.Of(field) {
+	case VISIBILITY_PUBLIC:
+		return true
+	case VISIBILITY_CLASSMATES:
+		return !a.unverified && (a.classmate || a.isFriend())
+	case VISIBILITY_FRIENDS:
+		return !a.unverified && a.isFriend()
+	}
+
+	return false
+}
+
+// Fills in privacy settings for a whole list, a query per few hundred users
+func loadPrivacy(users []User) error {
+	index := make(map[int]*User, len(users))
+	ids := make([]interface{}, len(users))
+
+	for i := range users {
+		users[i].privacy = make(Privacy)
+
+		for field, visibility := range DefaultPrivacy {
+			users[i].privacy[field] = visibility
+		}
+
+		index[users[i].ID] = &users[i]
+		ids[i] = users[i].ID
+	}
+
+	batches, placeholders := idBatches(ids)
+
+	for i, batch := range batches {
+		if err := loadPrivacyBatch(index, placeholders[i], batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadPrivacyBatch(index map[int]*User, placeholders string, ids []interface{}) error {
+	rows, err := QueuedQuery("SELECT user_id, field, visibility FROM privacy_settings WHERE user_id IN ("+placeholders+");", ids...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var field string
+		var visibility Visibility
+
+		if err := rows.Scan(&id, &field, &visibility); err != nil {
+			return err
+		}
+
+		if _, ok := DefaultPrivacy[field]; ok {
+			index[id].privacy[field] = visibility
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,29 @@
+package database
+
+import "testing"
+
+func TestLoadPrivacyForManyUsers(t *testing.T) {
+	OpenTestDatabase(t)
+	users := insertTestUsers(t, 2*MAX_IDS_PER_QUERY+1)
+
+	// Every other user hides their email
+	if err := QueuedExec("INSERT INTO privacy_settings (user_id, field, visibility) SELECT id, ?, ? FROM users WHERE id % 2 = 0;", PRIVACY_FIELD_EMAIL, VISIBILITY_HIDDEN); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadPrivacy(users); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range users {
+		want := DefaultPrivacy[PRIVACY_FIELD_EMAIL]
+
+		if user.ID%2 == 0 {
+			want = VISIBILITY_HIDDEN
+		}
+
+		if got := user.privacy.Of(PRIVACY_FIELD_EMAIL); got != want {
+			t.Fatalf("user %d: email is %v, want %v", user.ID, got, want)
+		}
+	}
+}
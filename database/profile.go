@@ -0,0 +1,127 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Optional profile fields, each with its own privacy setting. Empty means unset
+type ProfileFields struct {
+	Major, Pronouns, Bio string
+	GraduationYear       int
+	Contacts             map[string]string
+}
+
+const (
+	MAX_MAJOR_LENGTH    = 100
+	MAX_PRONOUNS_LENGTH = 32
+	MAX_BIO_LENGTH      = 500
+	MAX_HANDLE_LENGTH   = 64
+
+	MIN_GRADUATION_YEAR = 1950
+)
+
+// Where people can be found besides email
+var ContactKinds = []string{"discord", "github", "instagram", "linkedin"}
+
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+var ErrorInvalidProfile error = fmt.Errorf("invalid profile field")
+
+// Printable, with newlines only when multiline, and no longer than max characters
+func validText(value string, max int, multiline bool) bool {
+	if utf8.RuneCountInString(value) > max {
+		return false
+	}
+
+	for _, r := range value {
+		if r == '\n' && multiline {
+			continue
+		}
+
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+ * Trims everything and checks it, in place:
+ *  - major and pronouns are single lines, the bio can have several
+ *  - graduation year is 0 or between 1950 and ten years from now
+ *  - contacts are only the known kinds, handles lose a leading @
+ *    and empty ones are dropped
+ */
+func (f *ProfileFields) Normalize() error {
+	f.Major = strings.TrimSpace(f.Major)
+	f.Pronouns = strings.TrimSpace(f.Pronouns)
+	f.Bio = strings.TrimSpace(strings.ReplaceAll(f.Bio, "\r\n", "\n"))
+
+	if !validText(f.Major, MAX_MAJOR_LENGTH, false) || !validText(f.Pronouns, MAX_PRONOUNS_LENGTH, false) || !validText(f.Bio, MAX_BIO_LENGTH, true) {
+		return ErrorInvalidProfile
+	}
+
+	if f.GraduationYear != 0 && (f.GraduationYear < MIN_GRADUATION_YEAR || f.GraduationYear > time.Now().Year()+10) {
+		return ErrorInvalidProfile
+	}
+
+	contacts := make(map[string]string)
+
+	for kind, handle := range f.Contacts {
+		known := false
+
+		for _, contactKind := range ContactKinds {
+			known = known || contactKind == kind
+		}
+
+		handle = strings.TrimPrefix(strings.TrimSpace(handle), "@")
+
+		if !known || len(handle) > MAX_HANDLE_LENGTH || (handle != "" && !handlePattern.MatchString(handle)) {
+			return ErrorInvalidProfile
+		}
+
+		if handle != "" {
+			contacts[kind] = handle
+		}
+	}
+
+	f.Contacts = contacts
+
+	return nil
+}
+
+// Contacts are stored as a JSON object, a bad one reads as none
+func decodeContacts(raw string) map[string]string {
+	contacts := make(map[string]string)
+	json.Unmarshal([]byte(raw), &contacts)
+	return contacts
+}
+
+// Replaces every field, so unset ones get cleared
+func (u *User) SetProfileFields(fields ProfileFields) error {
+	if err := fields.Normalize(); err != nil {
+		return err
+	}
+
+	contacts, err := json.Marshal(fields.Contacts)
+	if err != nil {
+		return err
+	}
+
+	err = QueuedExec("UPDATE users SET major = ?, graduation_year = ?, pronouns = ?, bio = ?, contacts = ? WHERE id = ?;",
+		fields.Major, fields.GraduationYear, fields.Pronouns, fields.Bio, string(contacts), u.ID)
+	if err != nil {
+		return err
+	}
+
+	u.ProfileFields = fields
+
+	return nil
+}
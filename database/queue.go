@@ -80,6 +80,16 @@ func QueuedExec(query string, args ...interface{}) error {
 	})
 }
 
+func QueuedExecResult(query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := GetQueue().EnqueueOperation(func() error {
+		var err error
+		result, err = db.Exec(query, args...)
+		return err
+	})
+	return result, err
+}
+
 func QueuedQuery(query string, args ...interface{}) (*sql.Rows, error) {
 	var rows *sql.Rows
 	err := GetQueue().EnqueueOperation(func() error {
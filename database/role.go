@@ -0,0 +1,95 @@
+package database
+
+// Roles are stored in users.privilege, higher roles include everything below them
+type Role int
+
+const (
+	ROLE_STUDENT Role = iota
+	ROLE_INSTRUCTOR
+	ROLE_MODERATOR
+	ROLE_ADMIN
+)
+
+var RoleNames = map[Role]string{
+	ROLE_STUDENT:    "student",
+	ROLE_INSTRUCTOR: "instructor",
+	ROLE_MODERATOR:  "moderator",
+	ROLE_ADMIN:      "admin",
+}
+
+func ParseRole(name string) (Role, bool) {
+	for role, roleName := range RoleNames {
+		if roleName == name {
+			return role, true
+		}
+	}
+
+	return ROLE_STUDENT, false
+}
+
+type Permission string
+
+const (
+	PERMISSION_VIEW_ROSTERS    Permission = "rosters:view"
+	PERMISSION_MODERATE        Permission = "content:moderate"
+	PERMISSION_VIEW_USERS      Permission = "users:view"
+	PERMISSION_MANAGE_ROLES    Permission = "roles:manage"
+	PERMISSION_MANAGE_INVITE   Permission = "invites:manage"
+	PERMISSION_MANAGE_WEBHOOKS Permission = "webhooks:manage"
+	PERMISSION_MANAGE_SYSTEM   Permission = "system:manage"
+)
+
+// What each role adds on top of the roles below it
+var rolePermissions = map[Role][]Permission{
+	ROLE_STUDENT:    {},
+	ROLE_INSTRUCTOR: {PERMISSION_VIEW_ROSTERS},
+	ROLE_MODERATOR:  {PERMISSION_MODERATE},
+	ROLE_ADMIN:      {PERMISSION_VIEW_USERS, PERMISSION_MANAGE_ROLES, PERMISSION_MANAGE_INVITE, PERMISSION_MANAGE_WEBHOOKS, PERMISSION_MANAGE_SYSTEM},
+}
+
+func (r Role) Permissions() []Permission {
+	permissions := make([]Permission, 0)
+
+	for role := ROLE_STUDENT; role <= r; role++ {
+		permissions = append(permissions, rolePermissions[role]...)
+	}
+
+	return permissions
+}
+
+// Unknown privilege values get no extra permissions
+func (u *User) Role() Role {
+	if _, ok := RoleNames[Role(u.Privilege)]; !ok {
+		return ROLE_STUDENT
+	}
+
+	return Role(u.Privilege)
+}
+
+func (u *User) Can(permission Permission) bool {
+	for _, p := range u.Role().Permissions() {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (u *User) SetRole(role Role) error {
+	u.Privilege = int(role)
+
+	return QueuedExec("UPDATE users SET privilege = ? WHERE id = ?;", u.Privilege, u.ID)
+}
+
+// Makes sure the configured accounts are admins, so there's always a way in.
+// Only verified accounts, otherwise anyone could sign up with the address
+func PromoteAdmins(emails []string) error {
+	for _, email := range emails {
+		if err := QueuedExec("UPDATE users SET privilege = ? WHERE email = ? AND verified = 1;", int(ROLE_ADMIN), email); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	GROUP_ROLE_OWNER  = "owner"
+	GROUP_ROLE_MEMBER = "member"
+)
+
+var ErrorGroupFull error = fmt.Errorf("study group is full")
+var ErrorAlreadyMember error = fmt.Errorf("already in the study group")
+var ErrorNotMember error = fmt.Errorf("not in the study group")
+
+// Either CRN is set, or Subject and Number are. Role is the viewer's, empty if they aren't in it
+type StudyGroup struct {
+	ID                          int
+	CRN, Subject, Number        string
+	Name, Description, Location string
+	Capacity, Members           int
+	Role                        string
+	CreatedAt                   time.Time
+}
+
+const selectStudyGroups = `SELECT study_groups.id, COALESCE(term_crn, ''), COALESCE(subject_code, ''), COALESCE(course_number, ''), name, description, location, capacity,
+    (SELECT COUNT(*) FROM study_group_members WHERE group_id = study_groups.id),
+    COALESCE((SELECT role FROM study_group_members WHERE group_id = study_groups.id AND user_id = ?), ''),
+    created_at FROM study_groups `
+
+func scanStudyGroup(row scanner) (*StudyGroup, error) {
+	var g StudyGroup
+	var created int64
+
+	if err := row.Scan(&g.ID, &g.CRN, &g.Subject, &g.Number, &g.Name, &g.Description, &g.Location, &g.Capacity, &g.Members, &g.Role, &created); err != nil {
+		return nil, err
+	}
+
+	g.CreatedAt = time.Unix(created, 0)
+
+	return &g, nil
+}
+
+func queryStudyGroups(query string, args ...interface{}) ([]StudyGroup, error) {
+	rows, err := QueuedQuery(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	groups := make([]StudyGroup, 0)
+
+	for rows.Next() {
+		g, err := scanStudyGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		groups = append(groups, *g)
+	}
+
+	return groups, rows.Err()
+}
+
+func nullable(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+
+	return value
+}
+
+// The owner joins as part of creating it
+func CreateStudyGroup(owner int, group StudyGroup) (*StudyGroup, error) {
+	tx, err := QueuedBegin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+
+	result, err := tx.Exec("INSERT INTO study_groups (term_crn, subject_code, course_number, name, description, capacity, location, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?);",
+		nullable(group.CRN), nullable(group.Subject), nullable(group.Number), group.Name, group.Description, group.Capacity, group.Location, now)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("INSERT INTO study_group_members (group_id, user_id, role, joined_at) VALUES (?, ?, ?, ?);", id, owner, GROUP_ROLE_OWNER, now); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return GetStudyGroup(int(id), owner)
+}
+
+func GetStudyGroup(id, viewer int) (*StudyGroup, error) {
+	return scanStudyGroup(QueuedQueryRow(selectStudyGroups+"WHERE study_groups.id = ?;", viewer, id))
+}
+
+// Groups for the section itself and for the course it's a section of
+func CourseStudyGroups(crn, subject, number string, viewer int) ([]StudyGroup, error) {
+	return queryStudyGroups(selectStudyGroups+"WHERE term_crn = ? OR (subject_code = ? AND course_number = ?) ORDER BY created_at;", viewer, crn, subject, number)
+}
+
+func UserStudyGroups(userID int) ([]StudyGroup, error) {
+	return queryStudyGroups(selectStudyGroups+"WHERE study_groups.id IN (SELECT group_id FROM study_group_members WHERE user_id = ?) ORDER BY name;", userID, userID)
+}
+
+// A capacity of 0 means there's no limit
+func JoinStudyGroup(groupID, userID int) error {
+	if group, err := GetStudyGroup(groupID, userID); err != nil {
+		return err
+	} else if group.Role != "" {
+		return ErrorAlreadyMember
+	}
+
+	// Counting and inserting in one statement so the last seat can't be taken twice
+	result, err := QueuedExecResult(`INSERT INTO study_group_members (group_id, user_id, role, joined_at)
+    SELECT id, ?, ?, ? FROM study_groups WHERE id = ? AND (capacity = 0 OR capacity > (SELECT COUNT(*) FROM study_group_members WHERE group_id = ?));`,
+		userID, GROUP_ROLE_MEMBER, time.Now().Unix(), groupID, groupID)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected != 1 {
+		return ErrorGroupFull
+	}
+
+	return nil
+}
+
+// When the owner leaves, whoever has been in the longest takes over. The last one out deletes the group
+func LeaveStudyGroup(groupID, userID int) error {
+	tx, err := QueuedBegin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := leaveStudyGroup(tx, groupID, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func leaveStudyGroup(tx *sql.Tx, groupID, userID int) error {
+	var role string
+
+	if err := tx.QueryRow("SELECT role FROM study_group_members WHERE group_id = ? AND user_id = ?;", groupID, userID).Scan(&role); err == sql.ErrNoRows {
+		return ErrorNotMember
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM study_group_members WHERE group_id = ? AND user_id = ?;", groupID, userID); err != nil {
+		return err
+	}
+
+	if role != GROUP_ROLE_OWNER {
+		return nil
+	}
+
+	result, err := tx.Exec("UPDATE study_group_members SET role = ? WHERE group_id = ? AND user_id = (SELECT user_id FROM study_group_members WHERE group_id = ? ORDER BY joined_at, rowid LIMIT 1);", GROUP_ROLE_OWNER, groupID, groupID)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		if _, err := tx.Exec("DELETE FROM study_groups WHERE id = ?;", groupID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes the group along with everyone in it
+func DeleteStudyGroup(groupID int) error {
+	tx, err := QueuedBegin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM study_group_members WHERE group_id = ?;", groupID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM study_groups WHERE id = ?;", groupID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Members in the order they joined, owner first
+func StudyGroupMembers(groupID int) ([]User, []string, error) {
+	rows, err := QueuedQuery(`SELECT users.id, email, first_name, last_name, password, privilege, verified, major, graduation_year, pronouns, bio, contacts, study_group_members.role FROM users
+    JOIN study_group_members ON study_group_members.user_id = users.id WHERE study_group_members.group_id = ?
+    ORDER BY study_group_members.role = 'owner' DESC, study_group_members.joined_at;`, groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	users := make([]User, 0)
+	roles := make([]string, 0)
+
+	for rows.Next() {
+		var u User
+		var contacts, role string
+
+		if err := rows.Scan(&u.ID, &u.Email, &u.FirstName, &u.LastName, &u.PasswordHash, &u.Privilege, &u.Verified,
+			&u.Major, &u.GraduationYear, &u.Pronouns, &u.Bio, &contacts, &role); err != nil {
+			return nil, nil, err
+		}
+
+		u.Contacts = decodeContacts(contacts)
+
+		users = append(users, u)
+		roles = append(roles, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows.Close()
+
+	if err := loadCourses(users); err != nil {
+		return nil, nil, err
+	}
+
+	return users, roles, loadPrivacy(users)
+}
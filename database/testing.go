@@ -0,0 +1,28 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"hacknhbackend.eparker.dev/util"
+)
+
+// A fresh, fully migrated database for the test, thrown away afterwards.
+// Tests in other packages use it too, so it can't live in a _test file
+func OpenTestDatabase(t testing.TB) {
+	t.Helper()
+
+	util.Config.Database.FileName = filepath.Join(t.TempDir(), "test.db")
+	util.Config.Database.QueueSize = 16
+	util.Config.Database.PasswordSalt = "test"
+
+	if _, err := OpenDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { CloseDatabase() })
+
+	if _, err := Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const RECOVERY_CODE_COUNT = 10
+
+type TOTP struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+func GetTOTP(userID int) (*TOTP, error) {
+	row := QueuedQueryRow("SELECT secret, enabled, last_step FROM totp WHERE user_id = ?;", userID)
+
+	var t TOTP
+	if err := row.Scan(&t.Secret, &t.Enabled, &t.LastStep); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// True when logging in needs a second step
+func TwoFactorEnabled(userID int) bool {
+	t, err := GetTOTP(userID)
+	return err == nil && t.Enabled
+}
+
+// Stores a secret that isn't used for logins until it's been confirmed
+func SetPendingTOTP(userID int, secret string) error {
+	return QueuedExec("INSERT INTO totp (user_id, secret, enabled, last_step) VALUES (?, ?, 0, 0) ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, enabled = 0, last_step = 0;", userID, secret)
+}
+
+func EnableTOTP(userID int) error {
+	return QueuedExec("UPDATE totp SET enabled = 1 WHERE user_id = ?;", userID)
+}
+
+func DisableTOTP(userID int) error {
+	if err := QueuedExec("DELETE FROM totp WHERE user_id = ?;", userID); err != nil {
+		return err
+	}
+
+	return QueuedExec("DELETE FROM recovery_codes WHERE user_id = ?;", userID)
+}
+
+// Records the step a code was accepted for, false if it (or a later one) was already used
+func UseTOTPStep(userID int, step int64) bool {
+	result, err := QueuedExecResult("UPDATE totp SET last_step = ? WHERE user_id = ? AND last_step < ?;", step, userID, step)
+	if err != nil {
+		return false
+	}
+
+	affected, err := result.RowsAffected()
+	return err == nil && affected == 1
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// Replaces any old recovery codes, the plain codes are only ever returned here
+func CreateRecoveryCodes(userID int) ([]string, error) {
+	if err := QueuedExec("DELETE FROM recovery_codes WHERE user_id = ?;", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RECOVERY_CODE_COUNT)
+
+	for i := range codes {
+		bytes := make([]byte, 5)
+
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, err
+		}
+
+		raw := fmt.Sprintf("%x", bytes)
+		codes[i] = raw[:5] + "-" + raw[5:]
+
+		if err := QueuedExec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?);", userID, HashToken(normalizeRecoveryCode(codes[i]))); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+func UseRecoveryCode(userID int, code string) bool {
+	result, err := QueuedExecResult("UPDATE recovery_codes SET used_at = ? WHERE id = (SELECT id FROM recovery_codes WHERE user_id = ? AND code_hash = ? AND used_at IS NULL LIMIT 1);", time.Now().Unix(), userID, HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false
+	}
+
+	affected, err := result.RowsAffected()
+	return err == nil && affected == 1
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"hacknhbackend.eparker.dev/totp"
+)
+
+func TestTOTPStepsAreUsedOnce(t *testing.T) {
+	OpenTestDatabase(t)
+	user := createTestUser(t, "twofactor@example.edu")
+
+	if err := SetPendingTOTP(user.ID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"); err != nil || EnableTOTP(user.ID) != nil {
+		t.Fatal(err)
+	}
+
+	step := totp.Step(time.Now())
+
+	if !UseTOTPStep(user.ID, step) {
+		t.Fatal("first use of the step refused")
+	}
+
+	if UseTOTPStep(user.ID, step) {
+		t.Fatal("same step accepted twice")
+	}
+
+	if UseTOTPStep(user.ID, step-1) {
+		t.Fatal("earlier step accepted after a later one")
+	}
+
+	if !UseTOTPStep(user.ID, step+1) {
+		t.Fatal("next step refused")
+	}
+
+	if saved, err := GetTOTP(user.ID); err != nil || saved.LastStep != step+1 {
+		t.Fatalf("last step is %v (%v), want %d", saved, err, step+1)
+	}
+}
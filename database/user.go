@@ -1,9 +1,5 @@
 package database
 
-import (
-	"strings"
-)
-
 func CreateUser(email, first, last, password string) (*User, int) {
 	// Check if user already exists
 	_, err := GetUser(email)
@@ -13,7 +9,10 @@ func CreateUser(email, first, last, password string) (*User, int) {
 	}
 
 	err = QueuedExec(INSERT_USER_STATEMENT, email, first, last, HashPassword(password), "")
-	if err != nil {
+	if isUniqueViolation(err) {
+		// Signed up at the same moment as someone else with the address
+		return nil, CREATE_USER_ERROR_IMUsed
+	} else if err != nil {
 		return nil, CREATE_USER_ERROR_InternalServerError
 	}
 
@@ -24,90 +23,108 @@ func CreateUser(email, first, last, password string) (*User, int) {
 	}
 }
 
-func GetUser(email string) (*User, error) {
-	row := QueuedQueryRow(SELECT_USER_STATEMENT, email)
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
 
-	var intPtr int
+// Scans a row selected with the column order of SELECT_USER_STATEMENT
+func scanUser(row scanner) (*User, error) {
 	var user User
-	var courses string
-	err := row.Scan(&intPtr, &user.Email, &user.FirstName, &user.LastName, &user.PasswordHash, &courses, &user.Privilege)
+	var contacts string
+	err := row.Scan(&user.ID, &user.Email, &user.FirstName, &user.LastName, &user.PasswordHash, &user.Privilege, &user.Verified,
+		&user.Major, &user.GraduationYear, &user.Pronouns, &user.Bio, &contacts)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, class := range strings.Split(courses, ",") {
-		if class != "" {
-			user.Courses = append(user.Courses, class)
-		}
-	}
+	user.Contacts = decodeContacts(contacts)
 
 	return &user, nil
 }
 
-func DeleteUser(username string) error {
-	return QueuedExec("DELETE FROM users WHERE username = ?;", username)
+// Single users come with their courses, lists load them with loadCourses
+func scanUserWithCourses(row scanner) (*User, error) {
+	user, err := scanUser(row)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Courses, err = userCourses(user.ID); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func GetUser(email string) (*User, error) {
+	return scanUserWithCourses(QueuedQueryRow(SELECT_USER_STATEMENT, email))
+}
+
+func GetUserByID(id int) (*User, error) {
+	return scanUserWithCourses(QueuedQueryRow(SELECT_USER_BY_ID_STATEMENT, id))
 }
 
 func AllUsers() ([]User, error) {
-	rows, err := QueuedQuery("SELECT id, email, first_name, last_name, password, classes, privilege FROM users;")
+	rows, err := QueuedQuery(SELECT_USERS_STATEMENT)
 	if err != nil {
 		return nil, err
 	}
 
+	defer rows.Close()
+
 	users := make([]User, 0)
 
 	for rows.Next() {
-		var idPtr int
-		var user User
-		var courses string
-		err := rows.Scan(&idPtr, &user.Email, &user.FirstName, &user.LastName, &user.PasswordHash, &courses, &user.Privilege)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		for _, class := range strings.Split(courses, ",") {
-			if class != "" {
-				user.Courses = append(user.Courses, class)
-			}
-		}
+		users = append(users, *user)
+	}
 
-		users = append(users, user)
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows.Close()
+
+	if err := loadCourses(users); err != nil {
+		return nil, err
 	}
 
-	return users, nil
+	return users, loadPrivacy(users)
 }
 
-// Every user with 1+ courses in common with the given user
+// Every user enrolled in the course
 func UsersInCourse(crn string) ([]User, error) {
-	rows, err := QueuedQuery("SELECT id, email, first_name, last_name, password, classes, privilege FROM users;")
+	rows, err := QueuedQuery(SELECT_USERS_IN_COURSE_STATEMENT, crn)
 	if err != nil {
 		return nil, err
 	}
 
+	defer rows.Close()
+
 	users := make([]User, 0)
 
 	for rows.Next() {
-		var idPtr int
-		var u User
-		var courses string
-		err := rows.Scan(&idPtr, &u.Email, &u.FirstName, &u.LastName, &u.PasswordHash, &courses, &u.Privilege)
+		u, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		for _, class := range strings.Split(courses, ",") {
-			if class != "" {
-				u.Courses = append(u.Courses, class)
-			}
-		}
+		users = append(users, *u)
+	}
 
-		for _, class := range u.Courses {
-			if class == crn {
-				users = append(users, u)
-				break
-			}
-		}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows.Close()
+
+	if err := loadCourses(users); err != nil {
+		return nil, err
 	}
 
-	return users, nil
+	return users, loadPrivacy(users)
 }
@@ -2,11 +2,18 @@ package database
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/mail"
 	"strings"
+	"time"
 
 	"hacknhbackend.eparker.dev/util"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 func HashPassword(password string) string {
@@ -15,10 +22,33 @@ func HashPassword(password string) string {
 	return string(hash.Sum(nil))
 }
 
+// One-time tokens are stored hashed so a leaked database can't be used to log in
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+const MIN_PASSWORD_LENGTH = 8
+
+func ValidPassword(password string) bool {
+	return len(password) >= MIN_PASSWORD_LENGTH
+}
+
+// A bare address like "someone@unh.edu", no display names
+func ValidEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
 type User struct {
+	ID                                       int
 	Email, FirstName, LastName, PasswordHash string
 	Courses                                  []string
 	Privilege                                int
+	Verified                                 bool
+	ProfileFields
+
+	privacy Privacy
 }
 
 func (u *User) AddClass(crn string) error {
@@ -34,7 +64,7 @@ func (u *User) AddClass(crn string) error {
 
 	u.Courses = append(u.Courses, crn)
 
-	return QueuedExec("UPDATE users SET classes = ? WHERE email = ?;", strings.Join(u.Courses, ","), u.Email)
+	return QueuedExec("INSERT OR IGNORE INTO user_courses (user_id, term_crn, added_at) VALUES (?, ?, ?);", u.ID, crn, time.Now().Unix())
 }
 
 func (u *User) RemoveClass(crn string) error {
@@ -45,7 +75,7 @@ func (u *User) RemoveClass(crn string) error {
 		}
 	}
 
-	return QueuedExec("UPDATE users SET classes = ? WHERE email = ?;", strings.Join(u.Courses, ","), u.Email)
+	return QueuedExec("DELETE FROM user_courses WHERE user_id = ? AND term_crn = ?;", u.ID, crn)
 }
 
 func (u *User) ChangeName(first, last string) error {
@@ -55,13 +85,70 @@ func (u *User) ChangeName(first, last string) error {
 	return QueuedExec("UPDATE users SET first_name = ?, last_name = ? WHERE email = ?;", first, last, u.Email)
 }
 
+func (u *User) CheckPassword(password string) bool {
+	return subtle.ConstantTimeCompare([]byte(u.PasswordHash), []byte(HashPassword(password))) == 1
+}
+
+// Changing the email means it has to be verified again
+// ErrorEmailTaken when someone else already has it
+func (u *User) ChangeEmail(email string) error {
+	if err := QueuedExec("UPDATE users SET email = ?, verified = 0 WHERE id = ?;", email, u.ID); isUniqueViolation(err) {
+		return ErrorEmailTaken
+	} else if err != nil {
+		return err
+	}
+
+	u.Email = email
+	u.Verified = false
+
+	return nil
+}
+
+func (u *User) SetPassword(password string) error {
+	u.PasswordHash = HashPassword(password)
+
+	return QueuedExec("UPDATE users SET password = ? WHERE id = ?;", u.PasswordHash, u.ID)
+}
+
+func (u *User) MarkVerified() error {
+	u.Verified = true
+
+	return QueuedExec("UPDATE users SET verified = 1 WHERE id = ?;", u.ID)
+}
+
+// Removes every way of signing in besides the password: passkeys, the authenticator app and recovery codes
+func (u *User) ForgetCredentials() error {
+	tx, err := QueuedBegin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, table := range []string{"passkeys", "totp", "recovery_codes"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?;", u.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (u *User) JSON() []byte {
 	bytes, _ := json.Marshal(map[string]interface{}{
-		"email":   u.Email,
-		"first":   u.FirstName,
-		"last":    u.LastName,
-		"courses": u.Courses,
-		"priv":    u.Privilege,
+		"email":    u.Email,
+		"first":    u.FirstName,
+		"last":     u.LastName,
+		"courses":  u.Courses,
+		"priv":     u.Privilege,
+		"role":     RoleNames[u.Role()],
+		"verified": u.Verified,
+
+		"major":          u.Major,
+		"graduationYear": u.GraduationYear,
+		"pronouns":       u.Pronouns,
+		"bio":            u.Bio,
+		"contacts":       u.Contacts,
 	})
 
 	return bytes
@@ -69,22 +156,94 @@ func (u *User) JSON() []byte {
 
 type UserProfile struct {
 	Email, FirstName, LastName string
+	Courses                    []string `json:",omitempty"`
+
+	Major          string            `json:"major,omitempty"`
+	GraduationYear int               `json:"graduationYear,omitempty"`
+	Pronouns       string            `json:"pronouns,omitempty"`
+	Bio            string            `json:"bio,omitempty"`
+	Contacts       map[string]string `json:"contacts,omitempty"`
 }
 
-func (u *User) Profile() UserProfile {
-	return UserProfile{
-		Email:     u.Email,
-		FirstName: u.FirstName,
-		LastName:  u.LastName,
+// What the viewer is allowed to see of u, hidden fields are left empty
+func (u *User) Profile(viewer *User) UserProfile {
+	profile := UserProfile{}
+	audience := u.audience(viewer)
+
+	if audience.sees(PRIVACY_FIELD_EMAIL) {
+		profile.Email = u.Email
+	}
+
+	if audience.sees(PRIVACY_FIELD_NAME) {
+		profile.FirstName = u.FirstName
+		profile.LastName = u.LastName
+	}
+
+	if audience.sees(PRIVACY_FIELD_COURSES) {
+		profile.Courses = u.Courses
+	}
+
+	if u.Major != "" && audience.sees(PRIVACY_FIELD_MAJOR) {
+		profile.Major = u.Major
 	}
+
+	if u.GraduationYear != 0 && audience.sees(PRIVACY_FIELD_GRADUATION_YEAR) {
+		profile.GraduationYear = u.GraduationYear
+	}
+
+	if u.Pronouns != "" && audience.sees(PRIVACY_FIELD_PRONOUNS) {
+		profile.Pronouns = u.Pronouns
+	}
+
+	if u.Bio != "" && audience.sees(PRIVACY_FIELD_BIO) {
+		profile.Bio = u.Bio
+	}
+
+	if len(u.Contacts) > 0 && audience.sees(PRIVACY_FIELD_CONTACTS) {
+		profile.Contacts = u.Contacts
+	}
+
+	return profile
 }
 
-func (u *User) ProfileJSON() []byte {
-	bytes, _ := json.Marshal(map[string]interface{}{
-		"email": u.Email,
-		"first": u.FirstName,
-		"last":  u.LastName,
-	})
+func (u *User) ProfileJSON(viewer *User) []byte {
+	profile := u.Profile(viewer)
+	object := map[string]interface{}{}
+
+	if profile.Email != "" {
+		object["email"] = profile.Email
+	}
+
+	if profile.FirstName != "" || profile.LastName != "" {
+		object["first"] = profile.FirstName
+		object["last"] = profile.LastName
+	}
+
+	if profile.Courses != nil {
+		object["courses"] = profile.Courses
+	}
+
+	if profile.Major != "" {
+		object["major"] = profile.Major
+	}
+
+	if profile.GraduationYear != 0 {
+		object["graduationYear"] = profile.GraduationYear
+	}
+
+	if profile.Pronouns != "" {
+		object["pronouns"] = profile.Pronouns
+	}
+
+	if profile.Bio != "" {
+		object["bio"] = profile.Bio
+	}
+
+	if profile.Contacts != nil {
+		object["contacts"] = profile.Contacts
+	}
+
+	bytes, _ := json.Marshal(object)
 
 	return bytes
 }
@@ -94,6 +253,35 @@ const (
 	CREATE_USER_ERROR_IMUsed
 	CREATE_USER_ERROR_InternalServerError
 	CREATE_USER_ERROR_BadRequest
+	CREATE_USER_ERROR_Forbidden
 )
 
 var ErrorQueueTimeout error = fmt.Errorf("queue timeout")
+var ErrorInvalidToken error = fmt.Errorf("invalid or expired token")
+var ErrorUnknownField error = fmt.Errorf("unknown profile field")
+var ErrorEmailTaken error = fmt.Errorf("email already in use")
+
+// Whether a write failed because it would have broken a UNIQUE index or constraint
+func isUniqueViolation(err error) bool {
+	var sqliteError *sqlite.Error
+
+	return errors.As(err, &sqliteError) && sqliteError.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// SQLite won't take more than a few thousand ? in one statement, so long lists of ids are split up
+const MAX_IDS_PER_QUERY = 500
+
+// The ids in lists short enough for one IN (...), with the placeholders for each
+func idBatches(ids []interface{}) ([][]interface{}, []string) {
+	batches := make([][]interface{}, 0, len(ids)/MAX_IDS_PER_QUERY+1)
+	placeholders := make([]string, 0, cap(batches))
+
+	for start := 0; start < len(ids); start += MAX_IDS_PER_QUERY {
+		batch := ids[start:min(start+MAX_IDS_PER_QUERY, len(ids))]
+
+		batches = append(batches, batch)
+		placeholders = append(placeholders, "?"+strings.Repeat(", ?", len(batch)-1))
+	}
+
+	return batches, placeholders
+}
@@ -0,0 +1,60 @@
+package database
+
+import "testing"
+
+func TestForgetCredentials(t *testing.T) {
+	OpenTestDatabase(t)
+	user := createTestUser(t, "claimed@example.edu")
+	other := createTestUser(t, "other@example.edu")
+
+	for _, u := range []*User{user, other} {
+		if err := AddPasskey(u.ID, "credential-"+u.Email, []byte{1}, 0, "key"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := SetPendingTOTP(u.ID, "JBSWY3DPEHPK3PXP"); err != nil || EnableTOTP(u.ID) != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := CreateRecoveryCodes(u.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := user.ForgetCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []*User{user, other} {
+		passkeys, err := UserPasskeys(u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var codes int
+		db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?;", u.ID).Scan(&codes)
+
+		kept := len(passkeys) > 0 || TwoFactorEnabled(u.ID) || codes > 0
+		if kept != (u == other) {
+			t.Errorf("%s: passkeys %d, two-factor %v, recovery codes %d", u.Email, len(passkeys), TwoFactorEnabled(u.ID), codes)
+		}
+	}
+}
+
+func TestChangeEmailToATakenAddress(t *testing.T) {
+	OpenTestDatabase(t)
+	user := createTestUser(t, "mover@example.edu")
+	createTestUser(t, "taken@example.edu")
+
+	if err := user.ChangeEmail("taken@example.edu"); err != ErrorEmailTaken {
+		t.Fatalf("got %v, want ErrorEmailTaken", err)
+	}
+
+	if user.Email != "mover@example.edu" {
+		t.Fatalf("email changed to %s anyway", user.Email)
+	}
+
+	if stored, err := GetUserByID(user.ID); err != nil || stored.Email != "mover@example.edu" {
+		t.Fatalf("stored as %v (%v)", stored, err)
+	}
+}
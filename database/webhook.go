@@ -0,0 +1,223 @@
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_SUCCEEDED = "succeeded"
+	DELIVERY_FAILED    = "failed"
+)
+
+type Webhook struct {
+	ID, OwnerID int
+	URL, Secret string
+	Events      []string
+	Global      bool
+	CreatedAt   time.Time
+}
+
+type WebhookDelivery struct {
+	ID, WebhookID, Attempts int
+	Event, Payload, Status  string
+	ResponseCode            int
+	Error                   string
+	CreatedAt               time.Time
+	NextAttemptAt           *time.Time
+	FinishedAt              *time.Time
+}
+
+func (h *Webhook) Wants(event string) bool {
+	for _, wanted := range h.Events {
+		if wanted == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+const selectWebhooks = `SELECT id, owner_id, url, secret, events, global, created_at FROM webhooks `
+
+func scanWebhook(row scanner) (*Webhook, error) {
+	var h Webhook
+	var events string
+	var created int64
+
+	if err := row.Scan(&h.ID, &h.OwnerID, &h.URL, &h.Secret, &events, &h.Global, &created); err != nil {
+		return nil, err
+	}
+
+	h.Events = strings.Split(events, ",")
+	h.CreatedAt = time.Unix(created, 0)
+
+	return &h, nil
+}
+
+func queryWebhooks(query string, args ...interface{}) ([]Webhook, error) {
+	rows, err := QueuedQuery(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	hooks := make([]Webhook, 0)
+
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		hooks = append(hooks, *h)
+	}
+
+	return hooks, rows.Err()
+}
+
+// The secret is generated here, deliveries are signed with it
+func CreateWebhook(owner int, url string, events []string, global bool) (*Webhook, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := QueuedExecResult("INSERT INTO webhooks (owner_id, url, secret, events, global, created_at) VALUES (?, ?, ?, ?, ?, ?);",
+		owner, url, secret, strings.Join(events, ","), global, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return GetWebhook(int(id))
+}
+
+func GetWebhook(id int) (*Webhook, error) {
+	return scanWebhook(QueuedQueryRow(selectWebhooks+"WHERE id = ?;", id))
+}
+
+// The user's own hooks, plus every global one for people who manage them
+func UserWebhooks(owner int, withGlobal bool) ([]Webhook, error) {
+	return queryWebhooks(selectWebhooks+"WHERE owner_id = ? OR (global = 1 AND ?) ORDER BY created_at;", owner, withGlobal)
+}
+
+func AllWebhooks() ([]Webhook, error) {
+	return queryWebhooks(selectWebhooks + "ORDER BY id;")
+}
+
+// Takes its delivery log with it
+func DeleteWebhook(id int) error {
+	tx, err := QueuedBegin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?;", id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM webhooks WHERE id = ?;", id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const selectDeliveries = `SELECT id, webhook_id, event, payload, status, attempts, next_attempt_at, COALESCE(response_code, 0), error, created_at, finished_at FROM webhook_deliveries `
+
+func scanDelivery(row scanner) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	var created int64
+	var next, finished *int64
+
+	if err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &next, &d.ResponseCode, &d.Error, &created, &finished); err != nil {
+		return nil, err
+	}
+
+	d.CreatedAt = time.Unix(created, 0)
+	d.NextAttemptAt = optionalTime(next)
+	d.FinishedAt = optionalTime(finished)
+
+	return &d, nil
+}
+
+func queryDeliveries(query string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := QueuedQuery(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, *d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Due straight away
+func QueueDelivery(webhookID int, event, payload string) error {
+	now := time.Now().Unix()
+	return QueuedExec("INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?);",
+		webhookID, event, payload, DELIVERY_PENDING, now, now)
+}
+
+// Pending deliveries whose next attempt has come, oldest first
+func DueDeliveries(limit int) ([]WebhookDelivery, error) {
+	return queryDeliveries(selectDeliveries+"WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?;", DELIVERY_PENDING, time.Now().Unix(), limit)
+}
+
+// A page of the hook's log, newest first, and how many deliveries there are in all
+func WebhookDeliveries(webhookID, limit, offset int) ([]WebhookDelivery, int, error) {
+	var total int
+
+	if err := QueuedQueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE webhook_id = ?;", webhookID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	deliveries, err := queryDeliveries(selectDeliveries+"WHERE webhook_id = ? ORDER BY id DESC LIMIT ? OFFSET ?;", webhookID, limit, offset)
+
+	return deliveries, total, err
+}
+
+// Records an attempt. With a next time the delivery stays pending, otherwise status is final
+func (d *WebhookDelivery) RecordAttempt(status string, responseCode int, errorText string, next *time.Time) error {
+	d.Attempts++
+	d.Status, d.ResponseCode, d.Error, d.NextAttemptAt = status, responseCode, errorText, next
+
+	var nextAt, finishedAt interface{}
+
+	if next != nil {
+		nextAt = next.Unix()
+	} else {
+		now := time.Now()
+		d.FinishedAt = &now
+		finishedAt = now.Unix()
+	}
+
+	var code interface{}
+
+	if responseCode != 0 {
+		code = responseCode
+	}
+
+	return QueuedExec("UPDATE webhook_deliveries SET status = ?, attempts = ?, response_code = ?, error = ?, next_attempt_at = ?, finished_at = ? WHERE id = ?;",
+		status, d.Attempts, code, errorText, nextAt, finishedAt, d.ID)
+}
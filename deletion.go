@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/mailer"
+	"hacknhbackend.eparker.dev/util"
+)
+
+const ACCOUNT_PURGE_INTERVAL = time.Hour
+
+// Logging in during the grace period keeps the account
+func cancelAccountDeletion(email string) {
+	user, err := database.GetUser(email)
+
+	if err != nil {
+		return
+	}
+
+	cancelled, err := user.CancelDeletion()
+
+	if err != nil {
+		util.Log.Error(fmt.Sprintf("Error cancelling deletion of %s: %v", user.Email, err))
+		return
+	}
+
+	if !cancelled {
+		return
+	}
+
+	mailer.SendAsync(mailer.Message{
+		To:      user.Email,
+		Subject: "Your account won't be deleted",
+		Body:    fmt.Sprintf("Hi %s,\n\nYou logged in, so your account is no longer scheduled for deletion. If you still want it gone, delete it again.\n", user.FirstName),
+	})
+
+	util.Log.AddUser(fmt.Sprintf("User %s logged in and cancelled their deletion", user.Email))
+}
+
+// Deletes every account whose grace period is over and any expired data exports, checking again each interval
+func purgeDeletedAccounts() {
+	for {
+		cleanUpDataExports()
+
+		users, err := database.UsersDueForDeletion()
+
+		if err != nil {
+			util.Log.Error(fmt.Sprintf("Error loading accounts due for deletion: %v", err))
+		}
+
+		for _, user := range users {
+			if err := database.DeleteUser(user.ID); err == database.ErrorDeletionNotDue {
+				// They logged in or cancelled since the list was loaded
+				continue
+			} else if err != nil {
+				util.Log.Error(fmt.Sprintf("Error deleting user %s: %v", user.Email, err))
+				continue
+			}
+
+			RevokeTokens(user.Email)
+
+			mailer.SendAsync(mailer.Message{
+				To:      user.Email,
+				Subject: "Your account was deleted",
+				Body:    fmt.Sprintf("Hi %s,\n\nYour account and everything in it has now been deleted.\n", user.FirstName),
+			})
+
+			util.Log.RemoveUser(fmt.Sprintf("User %s deleted", user.Email))
+		}
+
+		time.Sleep(ACCOUNT_PURGE_INTERVAL)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/util"
+)
+
+const (
+	MAX_THREAD_TITLE = 200
+	MAX_POST_BODY    = 10000
+
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 100
+)
+
+// Pages start at 1, anything out of range falls back to the defaults
+func pagination(page, pageSize int) (int, int, int, int) {
+	if page < 1 {
+		page = 1
+	}
+
+	if pageSize < 1 || pageSize > MAX_PAGE_SIZE {
+		pageSize = DEFAULT_PAGE_SIZE
+	}
+
+	return page, pageSize, pageSize, (page - 1) * pageSize
+}
+
+func validPost(title, body string, needsTitle bool) bool {
+	if needsTitle && (title == "" || len(title) > MAX_THREAD_TITLE) {
+		return false
+	}
+
+	return body != "" && len(body) <= MAX_POST_BODY
+}
+
+// Looks up each author once per request, shown as much as their privacy settings allow
+type authorCache struct {
+	viewer  *database.User
+	authors map[int]database.UserProfile
+}
+
+func newAuthorCache(viewer *database.User) *authorCache {
+	return &authorCache{viewer: viewer, authors: make(map[int]database.UserProfile)}
+}
+
+func (c *authorCache) profile(id int) database.UserProfile {
+	if profile, ok := c.authors[id]; ok {
+		return profile
+	}
+
+	var profile database.UserProfile
+
+	if author, err := database.GetUserByID(id); err == nil {
+		profile = author.Profile(c.viewer)
+	}
+
+	c.authors[id] = profile
+
+	return profile
+}
+
+func threadJSON(thread *database.Thread, authors *authorCache) map[string]interface{} {
+	var edited interface{}
+
+	if thread.EditedAt != nil {
+		edited = thread.EditedAt.Unix()
+	}
+
+	return map[string]interface{}{
+		"id":       thread.ID,
+		"crn":      thread.CRN,
+		"title":    thread.Title,
+		"body":     thread.Body,
+		"author":   authors.profile(thread.AuthorID),
+		"mine":     thread.AuthorID == authors.viewer.ID,
+		"replies":  thread.Replies,
+		"created":  thread.CreatedAt.Unix(),
+		"edited":   edited,
+		"activity": thread.ActivityAt.Unix(),
+	}
+}
+
+func replyJSON(reply *database.Reply, authors *authorCache) map[string]interface{} {
+	var edited interface{}
+
+	if reply.EditedAt != nil {
+		edited = reply.EditedAt.Unix()
+	}
+
+	return map[string]interface{}{
+		"id":      reply.ID,
+		"thread":  reply.ThreadID,
+		"body":    reply.Body,
+		"author":  authors.profile(reply.AuthorID),
+		"mine":    reply.AuthorID == authors.viewer.ID,
+		"created": reply.CreatedAt.Unix(),
+		"edited":  edited,
+	}
+}
+
+func writeLookupError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func registerDiscussionRoutes() {
+	http.HandleFunc("/course/threads", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			CRN      string `json:"crn"`
+			Page     int    `json:"page"`
+			PageSize int    `json:"pageSize"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		page, pageSize, limit, offset := pagination(obj.Page, obj.PageSize)
+		threads, total, err := database.CourseThreads(obj.CRN, limit, offset)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		authors := newAuthorCache(user)
+		list := make([]map[string]interface{}, 0, len(threads))
+
+		for i := range threads {
+			list = append(list, threadJSON(&threads[i], authors))
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"threads":  list,
+			"page":     page,
+			"pageSize": pageSize,
+			"total":    total,
+		})
+	})
+
+	// Only people in the section can start threads in it
+	http.HandleFunc("/course/thread/create", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			CRN   string `json:"crn"`
+			Title string `json:"title"`
+			Body  string `json:"body"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		title, body := strings.TrimSpace(obj.Title), strings.TrimSpace(obj.Body)
+
+		if !validPost(title, body, true) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !user.EnrolledIn(obj.CRN) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		thread, err := database.CreateThread(obj.CRN, user.ID, title, body)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, threadJSON(thread, newAuthorCache(user)))
+	})
+
+	// The thread with a page of its replies
+	http.HandleFunc("/course/thread/get", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			ID       int `json:"id"`
+			Page     int `json:"page"`
+			PageSize int `json:"pageSize"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		thread, err := database.GetThread(obj.ID)
+
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+
+		page, pageSize, limit, offset := pagination(obj.Page, obj.PageSize)
+		replies, err := database.ThreadReplies(thread.ID, limit, offset)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		authors := newAuthorCache(user)
+		list := make([]map[string]interface{}, 0, len(replies))
+
+		for i := range replies {
+			list = append(list, replyJSON(&replies[i], authors))
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"thread":   threadJSON(thread, authors),
+			"replies":  list,
+			"page":     page,
+			"pageSize": pageSize,
+			"total":    thread.Replies,
+		})
+	})
+
+	http.HandleFunc("/course/thread/edit", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			ID    int    `json:"id"`
+			Title string `json:"title"`
+			Body  string `json:"body"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		title, body := strings.TrimSpace(obj.Title), strings.TrimSpace(obj.Body)
+
+		if !validPost(title, body, true) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		thread, err := database.GetThread(obj.ID)
+
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+
+		if thread.AuthorID != user.ID {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if err := thread.Edit(title, body); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, threadJSON(thread, newAuthorCache(user)))
+	})
+
+	// Authors can delete their own threads, moderators can remove anyone's
+	http.HandleFunc("/course/thread/delete", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			ID int `json:"id"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		thread, err := database.GetThread(obj.ID)
+
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+
+		if thread.AuthorID != user.ID && !user.Can(database.PERMISSION_MODERATE) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if err := thread.Delete(user.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		if thread.AuthorID != user.ID {
+			util.Log.Important(fmt.Sprintf("%s removed thread %d in %s", user.Email, thread.ID, thread.CRN))
+		}
+	})
+
+	http.HandleFunc("/course/reply/create", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			Thread int    `json:"thread"`
+			Body   string `json:"body"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		body := strings.TrimSpace(obj.Body)
+
+		if !validPost("", body, false) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		thread, err := database.GetThread(obj.Thread)
+
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+
+		if !user.EnrolledIn(thread.CRN) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		reply, err := database.CreateReply(thread.ID, user.ID, body)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, replyJSON(reply, newAuthorCache(user)))
+	})
+
+	http.HandleFunc("/course/reply/edit", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			ID   int    `json:"id"`
+			Body string `json:"body"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		body := strings.TrimSpace(obj.Body)
+
+		if !validPost("", body, false) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		reply, err := database.GetReply(obj.ID)
+
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+
+		if reply.AuthorID != user.ID {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if err := reply.Edit(body); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, replyJSON(reply, newAuthorCache(user)))
+	})
+
+	http.HandleFunc("/course/reply/delete", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			ID int `json:"id"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		reply, err := database.GetReply(obj.ID)
+
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+
+		if reply.AuthorID != user.ID && !user.Can(database.PERMISSION_MODERATE) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if err := reply.Delete(user.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		if reply.AuthorID != user.ID {
+			util.Log.Important(fmt.Sprintf("%s removed reply %d in thread %d", user.Email, reply.ID, reply.ThreadID))
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/events"
+)
+
+const EVENTS_HEARTBEAT = 20 * time.Second
+
+func writeEvent(w http.ResponseWriter, event events.Event) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+}
+
+func registerEventRoutes() {
+	/**
+	 * Server-sent events for the logged in user: notifications and
+	 * social events as they happen. Reconnecting with Last-Event-ID
+	 * replays what was missed, or sends "resync" when that's no longer
+	 * possible and the client should fetch everything again
+	 */
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		token, _ := r.Cookie("token")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// EventSource sends the header itself, the query parameter is for clients that can't set headers
+		lastEventID := r.Header.Get("Last-Event-ID")
+
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("lastEventId")
+		}
+
+		sub, missed, complete := events.Subscribe(user.ID, lastEventID)
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		fmt.Fprintf(w, "retry: %d\n\n", (5 * time.Second).Milliseconds())
+
+		if !complete {
+			fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+		}
+
+		for _, event := range missed {
+			writeEvent(w, event)
+		}
+
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(EVENTS_HEARTBEAT)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-sub.Events():
+				// Cut off for falling behind, the client reconnects and replays
+				if !ok {
+					return
+				}
+
+				writeEvent(w, event)
+				flusher.Flush()
+			case <-heartbeat.C:
+				// Logging out or the session running out ends the stream too
+				if !SessionValid(strings.ToLower(email.Value), token.Value) {
+					return
+				}
+
+				fmt.Fprint(w, ": heartbeat\n\n")
+				flusher.Flush()
+			}
+		}
+	})
+}
@@ -0,0 +1,296 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * In-memory fan-out of events to whoever is listening.
+ * Per-user events go to that user's /events streams, and
+ * broadcasts about the catalog as a whole go to listeners
+ * registered at startup, like webhooks. Each user keeps
+ * a short backlog so a client that drops can pick up
+ * where it left off. Ids carry the process they came from,
+ * after a restart there's no backlog and clients are told
+ * to fetch everything again instead
+ */
+
+const (
+	// How many events, and for how long, each user's backlog holds on to
+	BACKLOG_SIZE = 100
+	BACKLOG_AGE  = 10 * time.Minute
+
+	// Events queued per subscriber before it's cut off
+	SUBSCRIBER_BUFFER = 32
+)
+
+// Event types
+const (
+	NOTIFICATION    = "notification"
+	FRIEND_REQUEST  = "friend_request"
+	FRIEND_ACCEPTED = "friend_accepted"
+	DIRECT_MESSAGE  = "message"
+
+	// Broadcasts
+	COURSE_CHANGED = "course.changed"
+	COURSE_JOINED  = "course.joined"
+	SYNC_COMPLETED = "sync.completed"
+)
+
+type Event struct {
+	ID     string
+	UserID int
+	Type   string
+	Data   json.RawMessage
+	Time   time.Time
+
+	seq uint64
+}
+
+type Subscription struct {
+	userID int
+	events chan Event
+	once   sync.Once
+}
+
+type userEvents struct {
+	backlog     []Event
+	subscribers map[*Subscription]bool
+
+	// The newest event that's been let go of, clients that saw it are still complete
+	dropped uint64
+}
+
+var boot string = newBootID()
+var seq uint64
+
+var users map[int]*userEvents = make(map[int]*userEvents)
+var listeners []func(Event)
+var lock sync.Mutex
+
+// The newest event let go of by any user who's been forgotten, and when idle users were last looked for
+var forgotten uint64
+var swept time.Time
+
+func newBootID() string {
+	bytes := make([]byte, 4)
+	rand.Read(bytes)
+	return fmt.Sprintf("%x", bytes)
+}
+
+// Queues an event for the user, data is sent as JSON
+func Publish(userID int, kind string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	sweep()
+
+	seq++
+
+	event := Event{
+		ID:     fmt.Sprintf("%s-%d", boot, seq),
+		UserID: userID,
+		Type:   kind,
+		Data:   encoded,
+		Time:   time.Now(),
+		seq:    seq,
+	}
+
+	entry := entryFor(userID)
+	entry.prune()
+	entry.backlog = append(entry.backlog, event)
+
+	if len(entry.backlog) > BACKLOG_SIZE {
+		entry.dropped = entry.backlog[len(entry.backlog)-BACKLOG_SIZE-1].seq
+		entry.backlog = entry.backlog[len(entry.backlog)-BACKLOG_SIZE:]
+	}
+
+	for sub := range entry.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			// Too far behind to catch up, it can reconnect and replay
+			sub.close()
+		}
+	}
+
+	return nil
+}
+
+// Registers something to hear every broadcast
+func Listen(listener func(Event)) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	listeners = append(listeners, listener)
+}
+
+// Hands an event that isn't any one user's to every listener, in the caller's goroutine
+func Broadcast(kind string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	current := listeners
+	lock.Unlock()
+
+	event := Event{Type: kind, Data: encoded, Time: time.Now()}
+
+	for _, listener := range current {
+		listener(event)
+	}
+
+	return nil
+}
+
+// Users who were forgotten might have missed anything up to the watermark
+func entryFor(userID int) *userEvents {
+	entry := users[userID]
+
+	if entry == nil {
+		entry = &userEvents{subscribers: make(map[*Subscription]bool), dropped: forgotten}
+		users[userID] = entry
+	}
+
+	return entry
+}
+
+// Lets go of a user nobody's listening for once their backlog has aged out
+func forget(userID int, entry *userEvents) bool {
+	if len(entry.subscribers) > 0 {
+		return false
+	}
+
+	entry.prune()
+
+	if len(entry.backlog) > 0 {
+		return false
+	}
+
+	if entry.dropped > forgotten {
+		forgotten = entry.dropped
+	}
+
+	delete(users, userID)
+
+	return true
+}
+
+// Looks for idle users at most once per BACKLOG_AGE, nothing of theirs could be replayed anyway
+func sweep() {
+	if time.Since(swept) < BACKLOG_AGE {
+		return
+	}
+
+	swept = time.Now()
+
+	for userID, entry := range users {
+		forget(userID, entry)
+	}
+}
+
+// Lets go of events past BACKLOG_AGE
+func (e *userEvents) prune() {
+	cutoff := time.Now().Add(-BACKLOG_AGE)
+	keep := len(e.backlog)
+
+	for i, event := range e.backlog {
+		if event.Time.After(cutoff) {
+			keep = i
+			break
+		}
+	}
+
+	if keep > 0 {
+		e.dropped = e.backlog[keep-1].seq
+		e.backlog = e.backlog[keep:]
+	}
+}
+
+// The sequence number in one of our ids, false if it came from some other run
+func parseID(id string) (uint64, bool) {
+	prefix, number, ok := strings.Cut(id, "-")
+
+	if !ok || prefix != boot {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(number, 10, 64)
+
+	return n, err == nil
+}
+
+/**
+ * Starts listening for the user's events. With the id of the last
+ * event a client saw, also returns everything it missed since. If
+ * some of that is no longer around, complete is false and the client
+ * should refetch rather than trust the replay
+ */
+func Subscribe(userID int, lastEventID string) (sub *Subscription, missed []Event, complete bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	sweep()
+
+	entry := entryFor(userID)
+	entry.prune()
+
+	sub = &Subscription{userID: userID, events: make(chan Event, SUBSCRIBER_BUFFER)}
+	entry.subscribers[sub] = true
+
+	missed = make([]Event, 0)
+
+	if lastEventID == "" {
+		return sub, missed, true
+	}
+
+	last, ok := parseID(lastEventID)
+
+	if !ok || last > seq || entry.dropped > last {
+		return sub, missed, false
+	}
+
+	for _, event := range entry.backlog {
+		if event.seq > last {
+			missed = append(missed, event)
+		}
+	}
+
+	return sub, missed, true
+}
+
+// Closed when the subscription is cut off, by Close or for falling behind
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *Subscription) close() {
+	s.once.Do(func() {
+		delete(users[s.userID].subscribers, s)
+		close(s.events)
+	})
+}
+
+func (s *Subscription) Close() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	s.close()
+
+	if entry := users[s.userID]; entry != nil {
+		forget(s.userID, entry)
+	}
+}
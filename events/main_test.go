@@ -0,0 +1,76 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleUsersAreForgotten(t *testing.T) {
+	const userID = 1
+
+	Publish(userID, NOTIFICATION, map[string]string{"message": "first"})
+	Publish(userID, NOTIFICATION, map[string]string{"message": "second"})
+
+	lock.Lock()
+	first := users[userID].backlog[0].ID
+
+	// As if both happened long enough ago to have aged out
+	for i := range users[userID].backlog {
+		users[userID].backlog[i].Time = time.Now().Add(-2 * BACKLOG_AGE)
+	}
+
+	swept = time.Time{}
+	sweep()
+	_, kept := users[userID]
+	lock.Unlock()
+
+	if kept {
+		t.Fatal("idle user with an aged out backlog wasn't forgotten")
+	}
+
+	// The second event is gone, so picking up after the first can't be complete
+	sub, missed, complete := Subscribe(userID, first)
+	defer sub.Close()
+
+	if complete || len(missed) != 0 {
+		t.Fatalf("got %d missed, complete %v, want a resync", len(missed), complete)
+	}
+}
+
+func TestListenersKeepUsersAround(t *testing.T) {
+	const userID = 2
+
+	sub, _, _ := Subscribe(userID, "")
+
+	lock.Lock()
+	swept = time.Time{}
+	sweep()
+	_, kept := users[userID]
+	lock.Unlock()
+
+	if !kept {
+		t.Fatal("user with a subscriber was forgotten")
+	}
+
+	Publish(userID, FRIEND_REQUEST, map[string]string{"from": "someone"})
+
+	select {
+	case event := <-sub.Events():
+		if event.Type != FRIEND_REQUEST {
+			t.Fatalf("got %s, want %s", event.Type, FRIEND_REQUEST)
+		}
+	default:
+		t.Fatal("event wasn't delivered")
+	}
+
+	sub.Close()
+
+	// Closing keeps the backlog so a reconnect can replay it
+	lock.Lock()
+	_, kept = users[userID]
+	lock.Unlock()
+
+	if !kept {
+		t.Fatal("user with a backlog was forgotten on close")
+	}
+}
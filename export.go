@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/mailer"
+	"hacknhbackend.eparker.dev/util"
+)
+
+const (
+	EXPORT_FORMAT_JSON = "json"
+	EXPORT_FORMAT_ZIP  = "zip"
+)
+
+var exportThrottle *util.Throttle
+
+// A couple of exports a day is plenty, every request counts
+func initDataExports() {
+	exportThrottle = util.NewThrottle(2, time.Hour, 24*time.Hour)
+
+	if err := database.FailInterruptedDataExports(); err != nil {
+		util.Log.Error(fmt.Sprintf("Error failing interrupted data exports: %v", err))
+	}
+}
+
+// Throws away exports nobody downloaded in time, run with each account purge
+func cleanUpDataExports() {
+	if err := database.CleanUpDataExports(util.Config.Exports.LinkLifetime); err != nil {
+		util.Log.Error(fmt.Sprintf("Error cleaning up data exports: %v", err))
+	}
+}
+
+// The login session lives in memory, so it isn't part of what the database exports
+func sessionExport(email string) []map[string]interface{} {
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+
+	sessions := make([]map[string]interface{}, 0, 1)
+
+	if token, ok := tokens[email]; ok && token.Expires.After(time.Now()) {
+		sessions = append(sessions, map[string]interface{}{"expires_at": token.Expires.Unix()})
+	}
+
+	return sessions
+}
+
+// One JSON document, or a zip with a JSON file per section
+func encodeExport(sections map[string]interface{}, format string) ([]byte, error) {
+	if format == EXPORT_FORMAT_JSON {
+		return json.MarshalIndent(sections, "", "  ")
+	}
+
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+
+	names := make([]string, 0, len(sections))
+
+	for name := range sections {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		file, err := archive.Create(name + ".json")
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := json.MarshalIndent(sections[name], "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := file.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Runs in the background, the user gets an email with a download link once it's done
+func generateExport(user *database.User, format string) {
+	data, err := func() ([]byte, error) {
+		sections, err := database.ExportUserData(user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		sections["sessions"] = sessionExport(user.Email)
+		sections["exported_at"] = time.Now().Unix()
+
+		return encodeExport(sections, format)
+	}()
+
+	if err == nil {
+		err = database.FinishDataExport(user.ID, data)
+	}
+
+	if err != nil {
+		util.Log.Error(fmt.Sprintf("Error exporting data for %s: %v", user.Email, err))
+		database.FailDataExport(user.ID, "export failed")
+		return
+	}
+
+	token, err := database.CreateOneTimeToken(user.ID, database.TOKEN_PURPOSE_DATA_EXPORT, user.Email, util.Config.Exports.LinkLifetime)
+
+	if err != nil {
+		util.Log.Error(fmt.Sprintf("Error creating export link for %s: %v", user.Email, err))
+		database.FailDataExport(user.ID, "export failed")
+		return
+	}
+
+	mailer.SendAsync(mailer.Message{
+		To:      user.Email,
+		Subject: "Your data export is ready",
+		Body: fmt.Sprintf("Hi %s,\n\nThe copy of your data you asked for is ready. Follow this link within %v to download it:\n\n%s/export?token=%s\n\nIt only works once. If you didn't ask for it, change your password.\n",
+			user.FirstName, util.Config.Exports.LinkLifetime, util.Config.Server.PublicURL, url.QueryEscape(token)),
+	})
+
+	util.Log.Basic(fmt.Sprintf("Exported %d bytes of data for %s", len(data), user.Email))
+}
+
+func exportJSON(export *database.DataExport) map[string]interface{} {
+	var finished interface{}
+
+	if export.FinishedAt != nil {
+		finished = export.FinishedAt.Unix()
+	}
+
+	return map[string]interface{}{
+		"status":    export.Status,
+		"format":    export.Format,
+		"size":      export.Size,
+		"error":     export.Error,
+		"requested": export.RequestedAt.Unix(),
+		"finished":  finished,
+	}
+}
+
+func registerExportRoutes() {
+	// Starts an export of everything about the user, {"format": "json"} or "zip"
+	http.HandleFunc("/user/export", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			Format string `json:"format"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		if obj.Format == "" {
+			obj.Format = EXPORT_FORMAT_JSON
+		}
+
+		if obj.Format != EXPORT_FORMAT_JSON && obj.Format != EXPORT_FORMAT_ZIP {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if existing, err := database.GetDataExport(user.ID); err == nil && existing.Status == database.EXPORT_PENDING {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		if wait := exportThrottle.Wait(user.Email); wait > 0 {
+			tooManyRequests(w, wait)
+			return
+		}
+
+		exportThrottle.Fail(user.Email)
+
+		if err := database.StartDataExport(user.ID, obj.Format); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		go generateExport(user, obj.Format)
+
+		w.WriteHeader(http.StatusAccepted)
+
+		util.Log.Basic(fmt.Sprintf("User %s requested a data export", user.Email))
+	})
+
+	// How the latest export is coming along
+	http.HandleFunc("/user/export/status", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		export, err := database.GetDataExport(user.ID)
+
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+
+		writeJSON(w, exportJSON(export))
+	})
+
+	// Trades the token from the email for the file. Only the account it was made for can use it
+	http.HandleFunc("/user/export/download", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			Token string `json:"token"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Anyone else trying a leaked link uses it up, which is the safe way round
+		token, err := database.ConsumeOneTimeToken(database.TOKEN_PURPOSE_DATA_EXPORT, obj.Token)
+
+		if err != nil || token.UserID != user.ID {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		format, data, err := database.TakeDataExport(user.ID)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusGone)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		contentType := "application/json"
+
+		if format == EXPORT_FORMAT_ZIP {
+			contentType = "application/zip"
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"classly-export-%s.%s\"", time.Now().Format("2006-01-02"), format))
+		w.Write(data)
+
+		util.Log.Basic(fmt.Sprintf("User %s downloaded their data export", user.Email))
+	})
+}
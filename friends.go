@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/events"
+)
+
+// The logged in user and the one named in the request body, who has to be someone else.
+// The other user is nil when there's nobody by that email to befriend, callers answer
+// the same as they would for someone they aren't connected to so accounts can't be probed
+func friendPair(w http.ResponseWriter, r *http.Request) (*database.User, *database.User, bool) {
+	obj := struct {
+		Email string `json:"email"`
+	}{}
+
+	if !readJSON(w, r, &obj) {
+		return nil, nil, false
+	}
+
+	email, _ := r.Cookie("email")
+	user, err := database.GetUser(email.Value)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	other, err := database.GetUser(strings.ToLower(obj.Email))
+
+	if err != nil || !other.Verified {
+		return user, nil, true
+	}
+
+	if other.ID == user.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	return user, other, true
+}
+
+// Requests always show the email, it's how the other side answers them
+func profiles(users []database.User, viewer *database.User, withEmail bool) []database.UserProfile {
+	list := make([]database.UserProfile, 0, len(users))
+
+	for _, u := range users {
+		profile := u.Profile(viewer)
+
+		if withEmail {
+			profile.Email = u.Email
+		}
+
+		list = append(list, profile)
+	}
+
+	return list
+}
+
+// Not found or already answered are both just "no such request"
+func writeConnectionError(w http.ResponseWriter, err error) {
+	if err == database.ErrorNoConnection {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func registerFriendRoutes() {
+	// Friends plus requests waiting either way
+	http.HandleFunc("/user/friends", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		friends, err := database.Friends(user.ID)
+		incoming, err2 := database.IncomingFriendRequests(user.ID)
+		outgoing, err3 := database.OutgoingFriendRequests(user.ID)
+
+		if err != nil || err2 != nil || err3 != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"friends":  profiles(friends, user, false),
+			"incoming": profiles(incoming, user, true),
+			"outgoing": profiles(outgoing, user, true),
+		})
+	})
+
+	// Asking someone who already asked you makes you friends right away
+	http.HandleFunc("/user/friends/request", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		user, other, ok := friendPair(w, r)
+
+		if !ok {
+			return
+		}
+
+		if other == nil {
+			writeJSON(w, map[string]string{"status": database.CONNECTION_PENDING})
+			return
+		}
+
+		status, err := database.SendFriendRequest(user.ID, other.ID)
+
+		if err == database.ErrorAlreadyConnected {
+			w.WriteHeader(http.StatusConflict)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, map[string]string{"status": status})
+
+		if status == database.CONNECTION_ACCEPTED {
+			events.Publish(other.ID, events.FRIEND_ACCEPTED, map[string]interface{}{"user": user.Profile(other)})
+		} else {
+			events.Publish(other.ID, events.FRIEND_REQUEST, map[string]interface{}{"user": user.Profile(other)})
+		}
+	})
+
+	http.HandleFunc("/user/friends/accept", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		user, other, ok := friendPair(w, r)
+
+		if !ok {
+			return
+		}
+
+		if other == nil {
+			writeConnectionError(w, database.ErrorNoConnection)
+			return
+		}
+
+		if err := database.AcceptFriendRequest(user.ID, other.ID); err != nil {
+			writeConnectionError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		events.Publish(other.ID, events.FRIEND_ACCEPTED, map[string]interface{}{"user": user.Profile(other)})
+	})
+
+	http.HandleFunc("/user/friends/decline", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		user, other, ok := friendPair(w, r)
+
+		if !ok {
+			return
+		}
+
+		if other == nil {
+			writeConnectionError(w, database.ErrorNoConnection)
+			return
+		}
+
+		if err := database.DeclineFriendRequest(user.ID, other.ID); err != nil {
+			writeConnectionError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Unfriends, or cancels a request you sent
+	http.HandleFunc("/user/friends/remove", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		user, other, ok := friendPair(w, r)
+
+		if !ok {
+			return
+		}
+
+		if other == nil {
+			writeConnectionError(w, database.ErrorNoConnection)
+			return
+		}
+
+		if err := database.RemoveConnection(user.ID, other.ID); err != nil {
+			writeConnectionError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Every friend's courses in full, leaving out friends who hide them
+	http.HandleFunc("/user/friends/schedules", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		friends, err := database.Friends(user.ID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		type Schedule struct {
+			Friend  database.UserProfile `json:"friend"`
+			Courses []json.RawMessage    `json:"courses"`
+		}
+
+		schedules := make([]Schedule, 0)
+
+		for _, friend := range friends {
+			if !friend.CanSee(user, database.PRIVACY_FIELD_COURSES) {
+				continue
+			}
+
+			courses := make([]json.RawMessage, 0)
+
+			for _, crn := range friend.Courses {
+				if course, err := database.GetCourse(crn); err == nil {
+					courses = append(courses, course.JSON())
+				}
+			}
+
+			schedules = append(schedules, Schedule{
+				Friend:  friend.Profile(user),
+				Courses: courses,
+			})
+		}
+
+		writeJSON(w, schedules)
+	})
+}
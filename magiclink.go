@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/mailer"
+	"hacknhbackend.eparker.dev/util"
+)
+
+var magicLinkAccountThrottle, magicLinkIPThrottle *util.Throttle
+
+// Every link sent counts against the limit, not just failures
+func initMagicLinkThrottles() {
+	magicLinkAccountThrottle = util.NewThrottle(3, time.Minute, time.Hour)
+	magicLinkIPThrottle = util.NewThrottle(10, time.Minute, time.Hour)
+}
+
+// Responds OK whether or not the account exists
+func sendMagicLink(w http.ResponseWriter, r *http.Request, email string) {
+	if !util.Config.Auth.MagicLinks {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ip := clientIP(r)
+
+	if wait := max(magicLinkAccountThrottle.Wait(email), magicLinkIPThrottle.Wait(ip)); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+
+	magicLinkAccountThrottle.Fail(email)
+	magicLinkIPThrottle.Fail(ip)
+
+	w.WriteHeader(http.StatusOK)
+
+	user, err := database.GetUser(email)
+
+	if err != nil {
+		return
+	}
+
+	token, err := database.CreateOneTimeToken(user.ID, database.TOKEN_PURPOSE_MAGIC_LOGIN, user.Email, util.Config.Auth.MagicLinkLifetime)
+
+	if err != nil {
+		util.Log.Error(fmt.Sprintf("Error creating login link for %s: %v", user.Email, err))
+		return
+	}
+
+	mailer.SendAsync(mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Hi %s,\n\nFollow this link within %v to log in:\n\n%s/magic?token=%s\n\nIt only works once. If you didn't ask for it, you can ignore this email.\n",
+			user.FirstName, util.Config.Auth.MagicLinkLifetime, util.Config.Server.PublicURL, url.QueryEscape(token)),
+	})
+}
+
+func registerMagicLinkRoutes() {
+	// Trade the token from a login link for a session
+	http.HandleFunc("/user/login/magic", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !util.Config.Auth.MagicLinks {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		obj := struct {
+			Token string `json:"token"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		ip := clientIP(r)
+
+		if wait := loginIPThrottle.Wait(ip); wait > 0 {
+			tooManyRequests(w, wait)
+			return
+		}
+
+		token, err := database.ConsumeOneTimeToken(database.TOKEN_PURPOSE_MAGIC_LOGIN, obj.Token)
+
+		if err != nil {
+			loginIPThrottle.Fail(ip)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := database.GetUserByID(token.UserID)
+
+		// The link was sent to an address the account no longer uses
+		if err != nil || user.Email != token.Email {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Getting the email proves the address is theirs, not that they're who registered it
+		if !user.Verified {
+			if err := claimUnverifiedAccount(user); err != nil {
+				util.Log.Error(fmt.Sprintf("Error claiming %s through a magic link: %v", user.Email, err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// The link stands in for the password, not the second factor
+		if database.TwoFactorEnabled(user.ID) {
+			startTwoFactorLogin(w, user.Email)
+			return
+		}
+
+		loginSucceeded(user.Email)
+		setSessionCookies(w, user.Email)
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
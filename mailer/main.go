@@ -0,0 +1,111 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"hacknhbackend.eparker.dev/util"
+)
+
+type Message struct {
+	To, Subject, Body string
+}
+
+// Anything that can deliver a message. SMTP for production,
+// an outbox directory for local development.
+type Mailer interface {
+	Send(message Message) error
+}
+
+var Current Mailer
+
+func Init() {
+	if util.Config.Mail.SMTPHost != "" {
+		Current = &SMTPMailer{
+			Host:     util.Config.Mail.SMTPHost,
+			Port:     util.Config.Mail.SMTPPort,
+			Username: util.Config.Mail.SMTPUsername,
+			Password: util.Config.Mail.SMTPPassword,
+			From:     util.Config.Mail.From,
+		}
+
+		util.Log.Basic(fmt.Sprintf("Sending mail through %s:%d", util.Config.Mail.SMTPHost, util.Config.Mail.SMTPPort))
+		return
+	}
+
+	Current = &OutboxMailer{
+		Directory: util.Config.Mail.OutboxDirectory,
+		From:      util.Config.Mail.From,
+	}
+
+	util.Log.Basic(fmt.Sprintf("No SMTP host set, writing mail to %s", util.Config.Mail.OutboxDirectory))
+}
+
+// Sends in the background so handlers don't block on (or leak timing
+// information through) the mail server
+func SendAsync(message Message) {
+	go func() {
+		if err := Current.Send(message); err != nil {
+			util.Log.Error(fmt.Sprintf("Error sending mail to %s: %v", message.To, err))
+		}
+	}()
+}
+
+// Header values must never contain line breaks
+func clean(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+func (m Message) bytes(from string) []byte {
+	var buffer bytes.Buffer
+
+	fmt.Fprintf(&buffer, "From: %s\r\n", clean(from))
+	fmt.Fprintf(&buffer, "To: %s\r\n", clean(m.To))
+	fmt.Fprintf(&buffer, "Subject: %s\r\n", clean(m.Subject))
+	fmt.Fprintf(&buffer, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+	buffer.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buffer.WriteString("\r\n")
+	buffer.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+
+	return buffer.Bytes()
+}
+
+type SMTPMailer struct {
+	Host                     string
+	Port                     int
+	Username, Password, From string
+}
+
+func (m *SMTPMailer) Send(message Message) error {
+	var auth smtp.Auth
+
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	return smtp.SendMail(fmt.Sprintf("%s:%d", m.Host, m.Port), auth, m.From, []string{clean(message.To)}, message.bytes(m.From))
+}
+
+// Writes every message to its own .eml file instead of sending it
+type OutboxMailer struct {
+	Directory, From string
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]`)
+
+func (m *OutboxMailer) Send(message Message) error {
+	if err := os.MkdirAll(m.Directory, 0700); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), unsafeFileChars.ReplaceAllString(message.To, "_"))
+
+	return os.WriteFile(filepath.Join(m.Directory, name), message.bytes(m.From), 0600)
+}
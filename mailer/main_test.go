@@ -0,0 +1,68 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutboxMailerWritesMessage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	mailer := &OutboxMailer{Directory: dir, From: "classly@localhost"}
+
+	err := mailer.Send(Message{To: "someone@example.edu", Subject: "Reset your password", Body: "Hi\n\nFollow this link"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), "-someone@example.edu.eml") {
+		t.Fatalf("got %v, want one .eml file for the recipient", files)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := string(data)
+
+	for _, want := range []string{"From: classly@localhost\r\n", "To: someone@example.edu\r\n", "Subject: Reset your password\r\n", "\r\n\r\nHi\r\n\r\nFollow this link"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message is missing %q:\n%s", want, message)
+		}
+	}
+}
+
+func TestOutboxMailerCleansHeadersAndFileNames(t *testing.T) {
+	dir := t.TempDir()
+	mailer := &OutboxMailer{Directory: dir, From: "classly@localhost"}
+
+	err := mailer.Send(Message{To: "../evil@example.edu", Subject: "Hello\r\nBcc: victim@example.edu", Body: "Body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || strings.Contains(files[0].Name(), "/") || strings.HasPrefix(files[0].Name(), ".") {
+		t.Fatalf("got %v, want one file inside the outbox", files)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), "\r\nBcc:") {
+		t.Fatalf("subject broke into a new header:\n%s", data)
+	}
+}
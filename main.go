@@ -6,12 +6,17 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"hacknhbackend.eparker.dev/courseload"
 	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/events"
+	"hacknhbackend.eparker.dev/mailer"
 	"hacknhbackend.eparker.dev/util"
+	"hacknhbackend.eparker.dev/webhooks"
 )
 
 type Token struct {
@@ -20,6 +25,7 @@ type Token struct {
 }
 
 var tokens map[string]*Token = make(map[string]*Token)
+var tokensLock sync.Mutex
 
 func RandomString(length int) string {
 	bytes := make([]byte, length)
@@ -34,6 +40,9 @@ func RandomString(length int) string {
 }
 
 func TokenFor(email string) string {
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+
 	if token, ok := tokens[email]; ok {
 		if token.Expires.After(time.Now()) {
 			return token.Token
@@ -49,6 +58,65 @@ func TokenFor(email string) string {
 	return tokens[email].Token
 }
 
+// Like comparing against TokenFor, without issuing a new token
+func SessionValid(email, token string) bool {
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+
+	current, ok := tokens[email]
+
+	return ok && current.Expires.After(time.Now()) && current.Token == token
+}
+
+// Logs the user out everywhere
+func RevokeTokens(email string) {
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+
+	delete(tokens, email)
+}
+
+func setSessionCookies(w http.ResponseWriter, email string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "email",
+		Value:    email,
+		Path:     "/",
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+
+	token := TokenFor(email)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    token,
+		Path:     "/",
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+
+	// The frontend can't read our cookies, so hand it the matching CSRF token
+	w.Header().Set(CSRF_HEADER, CSRFTokenFor(token))
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "email",
+		Value:    "",
+		Path:     "/",
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    "",
+		Path:     "/",
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+}
+
 func withAuth(w http.ResponseWriter, r *http.Request) bool {
 	email, err := r.Cookie("email")
 
@@ -67,39 +135,114 @@ func withAuth(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
+// The logged in user, or nil for anyone without a live session
+func sessionUser(r *http.Request) *database.User {
+	email, emailErr := r.Cookie("email")
+	token, tokenErr := r.Cookie("token")
+
+	if emailErr != nil || tokenErr != nil || !SessionValid(strings.ToLower(email.Value), token.Value) {
+		return nil
+	}
+
+	user, err := database.GetUser(strings.ToLower(email.Value))
+
+	if err != nil {
+		return nil
+	}
+
+	return user
+}
+
 func withCors(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
-	if origin != "" {
+	if origin != "" && originAllowed(origin) {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 	}
 
+	w.Header().Set("Vary", "Origin")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+CSRF_HEADER)
+	w.Header().Set("Access-Control-Expose-Headers", CSRF_HEADER)
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 }
 
+// Checks the method and content type, then decodes the JSON body into obj
+func readJSON(w http.ResponseWriter, r *http.Request, obj interface{}) bool {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+
+	if r.Header.Get("Content-Type") != "text/plain" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+
+	if err != nil || json.Unmarshal(body, obj) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	if bytes, err := json.Marshal(obj); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bytes)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
 func main() {
 	util.LoadEnvFile()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+
 	database.Init()
+	mailer.Init()
+	initLoginThrottles()
+	initMagicLinkThrottles()
+	initVerifyThrottle()
+	initDataExports()
+	webhooks.Init()
+
+	if err := database.PromoteAdmins(util.Config.Auth.AdminEmails); err != nil {
+		util.Log.Error(fmt.Sprintf("Error promoting admins: %v", err))
+	}
 
 	if util.Config.General.UpdateCourses {
 		go database.CourseUpdates()
 	}
 
+	go purgeDeletedAccounts()
+
 	// Basic http server
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		withCors(w, r)
 		http.ServeFile(w, r, "index.html")
 	})
 
-	// All users (SAFE)
+	// All users, everything about them so only for admins
 	http.HandleFunc("/user/all", func(w http.ResponseWriter, r *http.Request) {
 		withCors(w, r)
+
+		if !withPermission(w, r, database.PERMISSION_VIEW_USERS) {
+			return
+		}
+
 		users, err := database.AllUsers()
 
 		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
@@ -113,7 +256,7 @@ func main() {
 		w.Write([]byte("[" + strings.Join(strs, ",") + "]"))
 	})
 
-	// Get user (SAFE)
+	// Get user, only the fields their privacy settings let the caller see
 	http.HandleFunc("/user/get", func(w http.ResponseWriter, r *http.Request) {
 		withCors(w, r)
 		if r.Method != "POST" {
@@ -141,14 +284,16 @@ func main() {
 		}
 
 		user, err := database.GetUser(strings.ToLower(obj.Email))
+		viewer := sessionUser(r)
 
-		if err != nil {
+		// Someone who can't see the email shouldn't learn the account exists either
+		if err != nil || !user.CanSee(viewer, database.PRIVACY_FIELD_EMAIL) {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(user.JSON())
+		w.Write(user.ProfileJSON(viewer))
 	})
 
 	// Create user
@@ -173,6 +318,7 @@ func main() {
 			First    string `json:"firstName"`
 			Last     string `json:"lastName"`
 			Password string `json:"password"`
+			Invite   string `json:"invite"`
 		}{}
 
 		err := json.Unmarshal(body, &obj)
@@ -182,7 +328,7 @@ func main() {
 			return
 		}
 
-		user, statusCode := database.CreateUser(strings.ToLower(obj.Email), obj.First, obj.Last, obj.Password)
+		user, statusCode := database.Signup(strings.ToLower(obj.Email), obj.First, obj.Last, obj.Password, obj.Invite)
 
 		if statusCode != database.CREATE_USER_SUCCESS {
 			switch statusCode {
@@ -190,6 +336,8 @@ func main() {
 				w.WriteHeader(http.StatusIMUsed)
 			case database.CREATE_USER_ERROR_BadRequest:
 				w.WriteHeader(http.StatusBadRequest)
+			case database.CREATE_USER_ERROR_Forbidden:
+				w.WriteHeader(http.StatusForbidden)
 			default:
 				w.WriteHeader(http.StatusInternalServerError)
 			}
@@ -197,25 +345,13 @@ func main() {
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "email",
-			Value:    strings.ToLower(obj.Email),
-			Path:     "/",
-			SameSite: http.SameSiteNoneMode,
-			Secure:   true,
-		})
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     "token",
-			Value:    TokenFor(strings.ToLower(obj.Email)),
-			Path:     "/",
-			SameSite: http.SameSiteNoneMode,
-			Secure:   true,
-		})
+		setSessionCookies(w, strings.ToLower(obj.Email))
 
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(user.JSON())
 
+		sendVerificationEmail(user)
+
 		util.Log.AddUser(fmt.Sprintf("User %s created", obj.Email))
 	})
 
@@ -238,6 +374,9 @@ func main() {
 		obj := struct {
 			Email    string `json:"email"`
 			Password string `json:"password"`
+			Ticket   string `json:"ticket"`
+			Code     string `json:"code"`
+			Magic    bool   `json:"magic"`
 		}{}
 
 		err := json.Unmarshal(body, &obj)
@@ -247,37 +386,66 @@ func main() {
 			return
 		}
 
-		user, err := database.GetUser(strings.ToLower(obj.Email))
+		// Email a login link instead of checking a password
+		if obj.Magic {
+			sendMagicLink(w, r, strings.ToLower(obj.Email))
+			return
+		}
 
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
+		// Second step for accounts with two-factor authentication
+		if obj.Ticket != "" {
+			finishTwoFactorLogin(w, r, obj.Ticket, obj.Code)
 			return
 		}
 
-		if user.PasswordHash != database.HashPassword(obj.Password) {
+		email := strings.ToLower(obj.Email)
+
+		// Throttled the same whether or not the account exists
+		if loginThrottled(w, r, email) {
+			return
+		}
+
+		user, err := database.GetUser(email)
+
+		if err != nil || !user.CheckPassword(obj.Password) {
+			loginFailed(r, email)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "email",
-			Value:    strings.ToLower(obj.Email),
-			Path:     "/",
-			SameSite: http.SameSiteNoneMode,
-			Secure:   true,
-		})
+		// The throttle isn't reset until the second step succeeds too
+		if database.TwoFactorEnabled(user.ID) {
+			startTwoFactorLogin(w, email)
+			return
+		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "token",
-			Value:    TokenFor(strings.ToLower(obj.Email)),
-			Path:     "/",
-			SameSite: http.SameSiteNoneMode,
-			Secure:   true,
-		})
+		loginSucceeded(email)
+		setSessionCookies(w, email)
 
 		w.WriteHeader(http.StatusOK)
 	})
 
+	registerPasswordRoutes()
+	registerVerifyRoutes()
+	registerAccountRoutes()
+	registerAdminRoutes()
+	registerSSORoutes()
+	registerCSRFRoutes()
+	registerTwoFactorRoutes()
+	registerPasskeyRoutes()
+	registerMagicLinkRoutes()
+	registerPrivacyRoutes()
+	registerProfileRoutes()
+	registerFriendRoutes()
+	registerStudyGroupRoutes()
+	registerDiscussionRoutes()
+	registerChatRoutes()
+	registerMessageRoutes()
+	registerNotificationRoutes()
+	registerEventRoutes()
+	registerWebhookRoutes()
+	registerExportRoutes()
+
 	// Me
 	http.HandleFunc("/user/me", func(w http.ResponseWriter, r *http.Request) {
 		withCors(w, r)
@@ -300,26 +468,12 @@ func main() {
 	// Logout
 	http.HandleFunc("/user/logout", func(w http.ResponseWriter, r *http.Request) {
 		withCors(w, r)
-		http.SetCookie(w, &http.Cookie{
-			Name:     "email",
-			Value:    "",
-			Path:     "/",
-			SameSite: http.SameSiteNoneMode,
-			Secure:   true,
-		})
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     "token",
-			Value:    "",
-			Path:     "/",
-			SameSite: http.SameSiteNoneMode,
-			Secure:   true,
-		})
+		clearSessionCookies(w)
 
 		w.WriteHeader(http.StatusOK)
 	})
 
-	// Delete user (self only)
+	// Delete user (self only). The account goes after the grace period, logging in before then cancels it
 	http.HandleFunc("/user/delete", func(w http.ResponseWriter, r *http.Request) {
 		withCors(w, r)
 		if !withAuth(w, r) {
@@ -332,32 +486,34 @@ func main() {
 		}
 
 		email, _ := r.Cookie("email")
-		err := database.DeleteUser(email.Value)
+		user, err := database.GetUser(email.Value)
 
 		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		deleteAt := time.Now().Add(util.Config.Auth.DeletionGracePeriod)
+
+		if err := user.ScheduleDeletion(deleteAt); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "email",
-			Value:    "",
-			Path:     "/",
-			SameSite: http.SameSiteNoneMode,
-			Secure:   true,
-		})
+		// Logged out everywhere, so logging back in is a deliberate choice
+		RevokeTokens(user.Email)
+		clearSessionCookies(w)
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "token",
-			Value:    "",
-			Path:     "/",
-			SameSite: http.SameSiteNoneMode,
-			Secure:   true,
-		})
+		writeJSON(w, map[string]int64{"deleteAt": deleteAt.Unix()})
 
-		w.WriteHeader(http.StatusOK)
+		mailer.SendAsync(mailer.Message{
+			To:      user.Email,
+			Subject: "Your account will be deleted",
+			Body: fmt.Sprintf("Hi %s,\n\nYour account will be deleted for good on %s. Log in before then if you change your mind.\n",
+				user.FirstName, deleteAt.Format("January 2, 2006 at 15:04 MST")),
+		})
 
-		util.Log.RemoveUser(fmt.Sprintf("User %s deleted", email.Value))
+		util.Log.RemoveUser(fmt.Sprintf("User %s scheduled for deletion on %s", user.Email, deleteAt.Format(time.RFC3339)))
 	})
 
 	http.HandleFunc("/user/addclass", func(w http.ResponseWriter, r *http.Request) {
@@ -398,10 +554,16 @@ func main() {
 		}
 
 		for _, crn := range crns {
+			enrolled := user.EnrolledIn(crn)
+
 			if err := user.AddClass(crn); err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+
+			if !enrolled && user.EnrolledIn(crn) {
+				events.Broadcast(events.COURSE_JOINED, map[string]interface{}{"crn": crn, "user": user.ID})
+			}
 		}
 
 		w.WriteHeader(http.StatusOK)
@@ -678,7 +840,8 @@ func main() {
 	http.HandleFunc("/community/takingmyclasses", func(w http.ResponseWriter, r *http.Request) {
 		withCors(w, r)
 
-		if !withAuth(w, r) {
+		// Only verified accounts can see (and be seen by) classmates
+		if !withVerified(w, r) {
 			return
 		}
 
@@ -695,6 +858,16 @@ func main() {
 			return
 		}
 
+		// ?friends=true narrows every course down to friends
+		var friends map[int]bool
+
+		if r.URL.Query().Get("friends") == "true" {
+			if friends, err = database.FriendIDs(user.ID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
 		var courses [][]database.User
 
 		for _, crn := range user.Courses {
@@ -715,8 +888,15 @@ func main() {
 		for i, list := range courses {
 			var users []database.UserProfile
 
-			for _, user := range list {
-				users = append(users, user.Profile())
+			for _, classmate := range list {
+				// Hiding your courses takes you off everyone else's list
+				if friends != nil && !friends[classmate.ID] {
+					continue
+				}
+
+				if classmate.Verified && classmate.CanSee(user, database.PRIVACY_FIELD_COURSES) {
+					users = append(users, classmate.Profile(user))
+				}
 			}
 
 			courseUsers = append(courseUsers, CourseUsers{
@@ -736,8 +916,8 @@ func main() {
 	var at string = fmt.Sprintf("%s:%d", util.Config.Server.Host, util.Config.Server.Port)
 
 	if util.Config.Server.TLS != "" {
-		http.ListenAndServeTLS(at, util.Config.Server.TLS+"/fullchain.pem", util.Config.Server.TLS+"/privkey.pem", nil)
+		http.ListenAndServeTLS(at, util.Config.Server.TLS+"/fullchain.pem", util.Config.Server.TLS+"/privkey.pem", withCSRF(http.DefaultServeMux))
 	} else {
-		http.ListenAndServe(at, nil)
+		http.ListenAndServe(at, withCSRF(http.DefaultServeMux))
 	}
 }
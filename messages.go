@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/events"
+)
+
+const MAX_DIRECT_MESSAGE = 5000
+
+// Classmates and friends can message each other, unless either one has blocked the other
+func canMessage(user, other *database.User) bool {
+	if user.ID == other.ID || !other.Verified || database.EitherBlocked(user.ID, other.ID) {
+		return false
+	}
+
+	return user.SharesCourseWith(other) || database.AreFriends(user.ID, other.ID)
+}
+
+func directMessageJSON(message *database.DirectMessage, viewer *database.User) map[string]interface{} {
+	var read interface{}
+
+	if message.ReadAt != nil {
+		read = message.ReadAt.Unix()
+	}
+
+	return map[string]interface{}{
+		"id":           message.ID,
+		"conversation": message.ConversationID,
+		"mine":         message.SenderID == viewer.ID,
+		"body":         message.Body,
+		"sent":         message.CreatedAt.Unix(),
+		"read":         read,
+	}
+}
+
+func conversationJSON(conversation *database.Conversation, viewer *database.User, authors *authorCache) map[string]interface{} {
+	var last interface{}
+
+	if conversation.LastMessage != nil {
+		last = directMessageJSON(conversation.LastMessage, viewer)
+	}
+
+	return map[string]interface{}{
+		"id":          conversation.ID,
+		"with":        authors.profile(conversation.OtherID),
+		"unread":      conversation.Unread,
+		"lastMessage": last,
+		"activity":    conversation.ActivityAt.Unix(),
+	}
+}
+
+// The logged in user and their conversation with the given id
+func conversationRequest(w http.ResponseWriter, r *http.Request, id int) (*database.User, *database.Conversation, bool) {
+	email, _ := r.Cookie("email")
+	user, err := database.GetUser(email.Value)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	conversation, err := database.GetConversation(id, user.ID)
+
+	if err != nil {
+		writeLookupError(w, err)
+		return nil, nil, false
+	}
+
+	return user, conversation, true
+}
+
+func registerMessageRoutes() {
+	// Conversations with the latest message in each, and how many are unread overall
+	http.HandleFunc("/user/conversations", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		conversations, err := database.UserConversations(user.ID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		authors := newAuthorCache(user)
+		list := make([]map[string]interface{}, 0, len(conversations))
+		unread := 0
+
+		for i := range conversations {
+			list = append(list, conversationJSON(&conversations[i], user, authors))
+			unread += conversations[i].Unread
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"conversations": list,
+			"unread":        unread,
+		})
+	})
+
+	// A page of the conversation, newest first. Reading doesn't mark anything as read
+	http.HandleFunc("/user/messages", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			Conversation int `json:"conversation"`
+			Page         int `json:"page"`
+			PageSize     int `json:"pageSize"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		user, conversation, ok := conversationRequest(w, r, obj.Conversation)
+
+		if !ok {
+			return
+		}
+
+		page, pageSize, limit, offset := pagination(obj.Page, obj.PageSize)
+		messages, err := database.ConversationMessages(conversation.ID, limit, offset)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		list := make([]map[string]interface{}, 0, len(messages))
+
+		for i := range messages {
+			list = append(list, directMessageJSON(&messages[i], user))
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"conversation": conversationJSON(conversation, user, newAuthorCache(user)),
+			"messages":     list,
+			"page":         page,
+			"pageSize":     pageSize,
+		})
+	})
+
+	// Either reply in a "conversation" or start one with "email"
+	http.HandleFunc("/user/messages/send", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			Conversation int    `json:"conversation"`
+			Email        string `json:"email"`
+			Body         string `json:"body"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		body := strings.TrimSpace(obj.Body)
+
+		if body == "" || len(body) > MAX_DIRECT_MESSAGE || (obj.Conversation == 0) == (obj.Email == "") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var conversation *database.Conversation
+		var other *database.User
+
+		if obj.Conversation != 0 {
+			if conversation, err = database.GetConversation(obj.Conversation, user.ID); err == nil {
+				other, err = database.GetUserByID(conversation.OtherID)
+			}
+		} else {
+			other, err = database.GetUser(strings.ToLower(obj.Email))
+		}
+
+		// Someone who can't be messaged looks the same as no one, so addresses can't be probed
+		if err == sql.ErrNoRows || (err == nil && (!other.Verified || !canMessage(user, other))) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if conversation == nil {
+			if conversation, err = database.ConversationBetween(user.ID, other.ID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		message, err := database.SendDirectMessage(conversation.ID, user.ID, body)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, directMessageJSON(message, user))
+
+		received := directMessageJSON(message, other)
+		received["from"] = user.Profile(other)
+
+		events.Publish(other.ID, events.DIRECT_MESSAGE, received)
+	})
+
+	http.HandleFunc("/user/messages/read", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			Conversation int `json:"conversation"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		user, conversation, ok := conversationRequest(w, r, obj.Conversation)
+
+		if !ok {
+			return
+		}
+
+		marked, err := database.MarkConversationRead(conversation.ID, user.ID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, map[string]int{"marked": marked})
+	})
+
+	http.HandleFunc("/user/blocked", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		blocked, err := database.BlockedUsers(user.ID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// The email is how they get unblocked, so it's always there
+		writeJSON(w, profiles(blocked, user, true))
+	})
+
+	// Stops messages both ways, the conversation so far stays readable
+	http.HandleFunc("/user/block", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		user, other, ok := friendPair(w, r)
+
+		if !ok {
+			return
+		}
+
+		// Nobody to block, but it looks the same as blocking someone
+		if other == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if err := database.BlockUser(user.ID, other.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	http.HandleFunc("/user/unblock", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		user, other, ok := friendPair(w, r)
+
+		if !ok {
+			return
+		}
+
+		if other == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := database.UnblockUser(user.ID, other.ID); err == database.ErrorNotBlocked {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/util"
+)
+
+/**
+ * Schema commands, for deployments that run with
+ * DATABASE_AUTO_MIGRATE=false:
+ *   server migrate          apply pending migrations
+ *   server migrate status   list migrations and whether they've run
+ */
+
+func runMigrateCommand(args []string) {
+	if _, err := database.OpenDatabase(); err != nil {
+		util.Log.Error(fmt.Sprintf("Error opening the database: %v", err))
+		os.Exit(1)
+	}
+
+	if len(args) > 0 && args[0] == "status" {
+		migrationStatus()
+		return
+	}
+
+	if len(args) > 0 {
+		util.Log.Error(fmt.Sprintf("Unknown migrate command %q, expected \"status\" or nothing", args[0]))
+		os.Exit(1)
+	}
+
+	applied, err := database.Migrate()
+
+	if err != nil {
+		util.Log.Error(fmt.Sprintf("Error migrating the database: %v", err))
+		os.Exit(1)
+	}
+
+	util.Log.Status(fmt.Sprintf("Applied %d migration(s), schema is at version %d", applied, database.LatestSchemaVersion()))
+}
+
+func migrationStatus() {
+	version, err := database.SchemaVersion()
+
+	if err != nil {
+		util.Log.Error(fmt.Sprintf("Error reading the schema version: %v", err))
+		os.Exit(1)
+	}
+
+	status, err := database.Migrations()
+
+	if err != nil {
+		util.Log.Error(fmt.Sprintf("Error reading migrations: %v", err))
+		os.Exit(1)
+	}
+
+	fmt.Printf("Schema version %d, this build knows up to %d\n\n", version, database.LatestSchemaVersion())
+
+	for _, migration := range status {
+		applied := "pending"
+
+		if migration.AppliedAt != nil {
+			applied = "applied " + migration.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+
+		fmt.Printf("%4d  %-24s %s\n", migration.Version, migration.Name, applied)
+	}
+
+	if version > database.LatestSchemaVersion() {
+		fmt.Println("\nThe database is newer than this build, the server won't start against it")
+		os.Exit(1)
+	}
+}
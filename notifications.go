@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"hacknhbackend.eparker.dev/database"
+)
+
+func registerNotificationRoutes() {
+	// Newest first, "unread" leaves out the ones already seen
+	http.HandleFunc("/user/notifications", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			Unread   bool `json:"unread"`
+			Page     int  `json:"page"`
+			PageSize int  `json:"pageSize"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		page, pageSize, limit, offset := pagination(obj.Page, obj.PageSize)
+		notifications, total, unread, err := database.UserNotifications(user.ID, obj.Unread, limit, offset)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		list := make([]json.RawMessage, 0, len(notifications))
+
+		for i := range notifications {
+			list = append(list, notifications[i].JSON())
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"notifications": list,
+			"page":          page,
+			"pageSize":      pageSize,
+			"total":         total,
+			"unread":        unread,
+		})
+	})
+
+	// Marks the listed "ids" (up to 100) as read, or everything when there aren't any
+	http.HandleFunc("/user/notifications/read", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			IDs []int `json:"ids"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		marked, err := database.MarkNotificationsRead(user.ID, obj.IDs)
+
+		if err == database.ErrorTooManyNotifications {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, map[string]int{"marked": marked})
+	})
+}
@@ -0,0 +1,204 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A tiny identity provider: discovery, a key set and a token endpoint that hands out one id token
+type mockProvider struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	idToken   string
+	keyStatus int
+	code      string
+	verifier  string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockProvider{key: key, keyStatus: http.StatusOK, code: "the-code"}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		if m.keyStatus != http.StatusOK {
+			w.WriteHeader(m.keyStatus)
+			w.Write([]byte(`{"keys": []}`))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key-1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		if r.PostForm.Get("code") != m.code || r.PostForm.Get("code_verifier") != m.verifier {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.idToken})
+	})
+
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+
+	return m
+}
+
+func (m *mockProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key-1"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (m *mockProvider) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            m.server.URL,
+		"aud":            "client",
+		"sub":            "1234",
+		"nonce":          nonce,
+		"email":          "someone@example.edu",
+		"email_verified": "true",
+		"given_name":     "Some",
+		"family_name":    "One",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+	}
+}
+
+func TestLoginAgainstMockProvider(t *testing.T) {
+	m := newMockProvider(t)
+
+	provider, err := Discover(m.server.URL+"/", "client", "", "http://localhost/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, challenge := NewPKCE()
+	m.verifier = verifier
+	m.idToken = m.sign(t, m.claims("the-nonce"))
+
+	authURL := provider.AuthURL("the-state", "the-nonce", challenge)
+
+	if !strings.HasPrefix(authURL, m.server.URL+"/authorize?") || !strings.Contains(authURL, "code_challenge="+challenge) {
+		t.Fatalf("unexpected auth url %s", authURL)
+	}
+
+	if _, err := provider.Exchange("wrong-code", verifier); err == nil {
+		t.Fatal("exchanged a wrong code")
+	}
+
+	idToken, err := provider.Exchange(m.code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := provider.Verify(idToken, "the-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Email != "someone@example.edu" || !claims.EmailVerified || claims.GivenName != "Some" {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	if _, err := provider.Verify(idToken, "another-nonce"); err == nil {
+		t.Fatal("accepted a token with the wrong nonce")
+	}
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+	m := newMockProvider(t)
+
+	provider, err := Discover(m.server.URL, "client", "", "http://localhost/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := m.claims("nonce")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+
+	otherClient := m.claims("nonce")
+	otherClient["aud"] = []string{"someone-else"}
+
+	otherIssuer := m.claims("nonce")
+	otherIssuer["iss"] = "https://evil.example.com"
+
+	tampered := m.sign(t, m.claims("nonce"))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	tests := map[string]string{
+		"expired":      m.sign(t, expired),
+		"other client": m.sign(t, otherClient),
+		"other issuer": m.sign(t, otherIssuer),
+		"tampered":     tampered,
+		"malformed":    "not.a-token",
+	}
+
+	for name, token := range tests {
+		if _, err := provider.Verify(token, "nonce"); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestFetchKeysChecksStatus(t *testing.T) {
+	m := newMockProvider(t)
+	m.keyStatus = http.StatusInternalServerError
+
+	provider, err := Discover(m.server.URL, "client", "", "http://localhost/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := provider.fetchKeys(); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("got %v, want an error naming the status", err)
+	}
+}
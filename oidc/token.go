@@ -0,0 +1,265 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Claims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"-"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	Expires       int64  `json:"exp"`
+	IssuedAt      int64  `json:"iat"`
+}
+
+// Room for clocks that don't quite agree
+const clockSkew = 2 * time.Minute
+
+// Checks the signature and the claims we depend on
+func (p *Provider) Verify(idToken, nonce string) (*Claims, error) {
+	parts := strings.Split(idToken, ".")
+
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	header := struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}{}
+
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := p.key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch header.Algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash[:], signature) != nil {
+			return nil, fmt.Errorf("bad id token signature")
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return nil, fmt.Errorf("bad id token signature")
+		}
+
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, hash[:], r, s) {
+			return nil, fmt.Errorf("bad id token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported id token algorithm %q", header.Algorithm)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+
+	// Some providers send these as strings
+	extra := struct {
+		Audience      json.RawMessage `json:"aud"`
+		EmailVerified interface{}     `json:"email_verified"`
+	}{}
+
+	if err := json.Unmarshal(payload, &extra); err != nil {
+		return nil, err
+	}
+
+	switch v := extra.EmailVerified.(type) {
+	case bool:
+		claims.EmailVerified = v
+	case string:
+		claims.EmailVerified = v == "true"
+	}
+
+	if strings.TrimSuffix(claims.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("id token issuer %q doesn't match", claims.Issuer)
+	}
+
+	if !audienceContains(extra.Audience, p.ClientID) {
+		return nil, fmt.Errorf("id token wasn't issued for this client")
+	}
+
+	now := time.Now()
+
+	if now.After(time.Unix(claims.Expires, 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("id token expired")
+	}
+
+	if time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)) {
+		return nil, fmt.Errorf("id token issued in the future")
+	}
+
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("id token nonce doesn't match")
+	}
+
+	return &claims, nil
+}
+
+func audienceContains(raw json.RawMessage, clientID string) bool {
+	var single string
+
+	if json.Unmarshal(raw, &single) == nil {
+		return single == clientID
+	}
+
+	var list []string
+
+	if json.Unmarshal(raw, &list) == nil {
+		for _, audience := range list {
+			if audience == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Looks up a signing key, refetching the key set (at most once a minute) when it's unknown
+func (p *Provider) key(id string) (interface{}, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", id)
+	}
+
+	keys, err := p.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", id)
+}
+
+func (p *Provider) fetchKeys() (map[string]interface{}, error) {
+	res, err := p.client.Get(p.jwksURI)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key set returned %s", res.Status)
+	}
+
+	set := struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}{}
+
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.KeyType {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				continue
+			}
+
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				continue
+			}
+
+			keys[k.KeyID] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if k.Curve != "P-256" {
+				continue
+			}
+
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				continue
+			}
+
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				continue
+			}
+
+			keys[k.KeyID] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+
+	return keys, nil
+}
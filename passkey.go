@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/mailer"
+	"hacknhbackend.eparker.dev/util"
+	"hacknhbackend.eparker.dev/webauthn"
+)
+
+// A registration or login waiting on the authenticator
+type passkeyCeremony struct {
+	Challenge []byte
+	UserID    int
+	Expires   time.Time
+}
+
+var (
+	passkeyCeremonies map[string]*passkeyCeremony = make(map[string]*passkeyCeremony)
+	passkeyLock       sync.Mutex
+)
+
+const PASSKEY_TIMEOUT = 5 * time.Minute
+
+func relyingParty() *webauthn.RelyingParty {
+	return &webauthn.RelyingParty{
+		ID:      util.Config.WebAuthn.RPID,
+		Origins: util.Config.WebAuthn.Origins,
+	}
+}
+
+// Opaque per-user handle the authenticator stores alongside a discoverable credential
+func userHandle(userID int) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userID))
+	return handle
+}
+
+func startCeremony(userID int) (string, []byte) {
+	id, challenge := RandomString(16), webauthn.NewChallenge()
+
+	passkeyLock.Lock()
+	defer passkeyLock.Unlock()
+
+	for key, c := range passkeyCeremonies {
+		if time.Now().After(c.Expires) {
+			delete(passkeyCeremonies, key)
+		}
+	}
+
+	passkeyCeremonies[id] = &passkeyCeremony{
+		Challenge: challenge,
+		UserID:    userID,
+		Expires:   time.Now().Add(PASSKEY_TIMEOUT),
+	}
+
+	return id, challenge
+}
+
+// Ceremonies are single use, whether or not they succeed
+func takeCeremony(id string) (*passkeyCeremony, bool) {
+	passkeyLock.Lock()
+	defer passkeyLock.Unlock()
+
+	c, ok := passkeyCeremonies[id]
+	delete(passkeyCeremonies, id)
+
+	if !ok || time.Now().After(c.Expires) {
+		return nil, false
+	}
+
+	return c, true
+}
+
+func decodeAll(values ...string) ([][]byte, bool) {
+	decoded := make([][]byte, len(values))
+
+	for i, value := range values {
+		bytes, err := webauthn.Encoding.DecodeString(value)
+
+		if err != nil {
+			return nil, false
+		}
+
+		decoded[i] = bytes
+	}
+
+	return decoded, true
+}
+
+func registerPasskeyRoutes() {
+	// Options for navigator.credentials.create()
+	http.HandleFunc("/user/passkey/register/begin", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		passkeys, err := database.UserPasskeys(user.ID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Don't register the same authenticator twice
+		exclude := make([]map[string]string, 0)
+
+		for _, p := range passkeys {
+			exclude = append(exclude, map[string]string{"type": "public-key", "id": p.CredentialID})
+		}
+
+		ceremony, challenge := startCeremony(user.ID)
+
+		writeJSON(w, map[string]interface{}{
+			"ceremony": ceremony,
+			"publicKey": map[string]interface{}{
+				"rp": map[string]string{
+					"id":   util.Config.WebAuthn.RPID,
+					"name": util.Config.WebAuthn.RPName,
+				},
+				"user": map[string]string{
+					"id":          webauthn.Encoding.EncodeToString(userHandle(user.ID)),
+					"name":        user.Email,
+					"displayName": user.FirstName + " " + user.LastName,
+				},
+				"challenge": webauthn.Encoding.EncodeToString(challenge),
+				"pubKeyCredParams": []map[string]interface{}{
+					{"type": "public-key", "alg": webauthn.ALG_ES256},
+					{"type": "public-key", "alg": webauthn.ALG_RS256},
+				},
+				"timeout":     PASSKEY_TIMEOUT.Milliseconds(),
+				"attestation": "none",
+				"authenticatorSelection": map[string]string{
+					"residentKey":      "required",
+					"userVerification": "preferred",
+				},
+				"excludeCredentials": exclude,
+			},
+		})
+	})
+
+	// The authenticator's response to create()
+	http.HandleFunc("/user/passkey/register/finish", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			Ceremony   string `json:"ceremony"`
+			Name       string `json:"name"`
+			Credential struct {
+				Response struct {
+					ClientDataJSON    string `json:"clientDataJSON"`
+					AttestationObject string `json:"attestationObject"`
+				} `json:"response"`
+			} `json:"credential"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		ceremony, ok := takeCeremony(obj.Ceremony)
+
+		if !ok || ceremony.UserID != user.ID {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		decoded, ok := decodeAll(obj.Credential.Response.ClientDataJSON, obj.Credential.Response.AttestationObject)
+
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		credential, err := relyingParty().VerifyRegistration(ceremony.Challenge, decoded[0], decoded[1])
+
+		if err != nil {
+			util.Log.Error(fmt.Sprintf("Rejected passkey registration for %s: %v", user.Email, err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if obj.Name == "" {
+			obj.Name = "Passkey"
+		}
+
+		credentialID := webauthn.Encoding.EncodeToString(credential.ID)
+
+		if err := database.AddPasskey(user.ID, credentialID, credential.PublicKey, credential.SignCount, obj.Name); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		writeJSON(w, map[string]string{"id": credentialID, "name": obj.Name})
+
+		mailer.SendAsync(mailer.Message{
+			To:      user.Email,
+			Subject: "A passkey was added to your account",
+			Body:    fmt.Sprintf("Hi %s,\n\nA passkey named %q was just added to your account. If this wasn't you, remove it and reset your password right away.\n", user.FirstName, obj.Name),
+		})
+
+		util.Log.Basic(fmt.Sprintf("User %s registered a passkey", user.Email))
+	})
+
+	http.HandleFunc("/user/passkey/list", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		passkeys, err := database.UserPasskeys(user.ID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		list := make([]map[string]interface{}, 0)
+
+		for _, p := range passkeys {
+			var lastUsed interface{}
+
+			if p.LastUsedAt != nil {
+				lastUsed = p.LastUsedAt.Unix()
+			}
+
+			list = append(list, map[string]interface{}{
+				"id":       p.CredentialID,
+				"name":     p.Name,
+				"created":  p.CreatedAt.Unix(),
+				"lastUsed": lastUsed,
+			})
+		}
+
+		writeJSON(w, list)
+	})
+
+	http.HandleFunc("/user/passkey/delete", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		obj := struct {
+			ID string `json:"id"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if deleted, err := database.DeletePasskey(user.ID, obj.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else if !deleted {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	// Options for navigator.credentials.get(), passkeys are discoverable so no email is needed
+	http.HandleFunc("/user/passkey/login/begin", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		ceremony, challenge := startCeremony(0)
+
+		writeJSON(w, map[string]interface{}{
+			"ceremony": ceremony,
+			"publicKey": map[string]interface{}{
+				"rpId":             util.Config.WebAuthn.RPID,
+				"challenge":        webauthn.Encoding.EncodeToString(challenge),
+				"timeout":          PASSKEY_TIMEOUT.Milliseconds(),
+				"userVerification": "preferred",
+			},
+		})
+	})
+
+	// The authenticator's response to get(), starts a session
+	http.HandleFunc("/user/passkey/login/finish", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		obj := struct {
+			Ceremony   string `json:"ceremony"`
+			Credential struct {
+				ID       string `json:"id"`
+				Response struct {
+					ClientDataJSON    string `json:"clientDataJSON"`
+					AuthenticatorData string `json:"authenticatorData"`
+					Signature         string `json:"signature"`
+					UserHandle        string `json:"userHandle"`
+				} `json:"response"`
+			} `json:"credential"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		if wait := loginIPThrottle.Wait(clientIP(r)); wait > 0 {
+			tooManyRequests(w, wait)
+			return
+		}
+
+		ceremony, ok := takeCeremony(obj.Ceremony)
+
+		if !ok || ceremony.UserID != 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		passkey, err := database.GetPasskey(obj.Credential.ID)
+
+		if err != nil {
+			loginIPThrottle.Fail(clientIP(r))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		decoded, ok := decodeAll(obj.Credential.Response.ClientDataJSON, obj.Credential.Response.AuthenticatorData, obj.Credential.Response.Signature, obj.Credential.Response.UserHandle)
+
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// The handle is optional, but has to be the owner's when it's there
+		if len(decoded[3]) > 0 && string(decoded[3]) != string(userHandle(passkey.UserID)) {
+			loginIPThrottle.Fail(clientIP(r))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		signCount, err := relyingParty().VerifyAssertion(ceremony.Challenge, &webauthn.Credential{
+			PublicKey: passkey.PublicKey,
+			SignCount: passkey.SignCount,
+		}, decoded[0], decoded[1], decoded[2])
+
+		if err != nil {
+			util.Log.Error(fmt.Sprintf("Rejected passkey login: %v", err))
+			loginIPThrottle.Fail(clientIP(r))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := database.GetUserByID(passkey.UserID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		passkey.Used(signCount)
+
+		// The passkey stands in for the password, not the second factor
+		if database.TwoFactorEnabled(user.ID) {
+			startTwoFactorLogin(w, user.Email)
+			return
+		}
+
+		loginSucceeded(user.Email)
+		setSessionCookies(w, user.Email)
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
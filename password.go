@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/mailer"
+	"hacknhbackend.eparker.dev/util"
+)
+
+func registerPasswordRoutes() {
+	// Forgot password, always responds OK so it can't be used to find accounts
+	http.HandleFunc("/user/password/forgot", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		obj := struct {
+			Email string `json:"email"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		user, err := database.GetUser(strings.ToLower(obj.Email))
+
+		if err != nil {
+			return
+		}
+
+		token, err := database.CreateOneTimeToken(user.ID, database.TOKEN_PURPOSE_PASSWORD_RESET, user.Email, util.Config.Auth.PasswordResetLifetime)
+
+		if err != nil {
+			util.Log.Error(fmt.Sprintf("Error creating reset token for %s: %v", user.Email, err))
+			return
+		}
+
+		mailer.SendAsync(mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, follow this link within %v:\n\n%s/reset?token=%s\n\nIf it wasn't, you can ignore this email.\n",
+				user.FirstName, util.Config.Auth.PasswordResetLifetime, util.Config.Server.PublicURL, url.QueryEscape(token)),
+		})
+	})
+
+	// Reset password with a token from the forgot password email
+	http.HandleFunc("/user/password/reset", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		obj := struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		// Check before consuming so a typo doesn't burn the token
+		if !database.ValidPassword(obj.Password) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		token, err := database.ConsumeOneTimeToken(database.TOKEN_PURPOSE_PASSWORD_RESET, obj.Token)
+
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := database.GetUserByID(token.UserID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := user.SetPassword(obj.Password); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		database.RevokeOneTimeTokens(user.ID, database.TOKEN_PURPOSE_PASSWORD_RESET)
+		RevokeTokens(user.Email)
+
+		w.WriteHeader(http.StatusOK)
+
+		mailer.SendAsync(mailer.Message{
+			To:      user.Email,
+			Subject: "Your password was changed",
+			Body:    fmt.Sprintf("Hi %s,\n\nThe password for your account was just reset. If this wasn't you, reset it again right away.\n", user.FirstName),
+		})
+
+		util.Log.Basic(fmt.Sprintf("User %s reset their password", user.Email))
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+
+	"hacknhbackend.eparker.dev/database"
+)
+
+func registerPrivacyRoutes() {
+	// Who can see each field, defaults included
+	http.HandleFunc("/user/privacy", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		privacy, err := user.Privacy()
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, privacy)
+	})
+
+	// Takes any number of fields, like {"email": "hidden", "courses": "classmates"}
+	http.HandleFunc("/user/privacy/update", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		obj := map[string]string{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		settings := make(database.Privacy)
+
+		for field, name := range obj {
+			visibility, ok := database.ParseVisibility(name)
+
+			if _, known := database.DefaultPrivacy[field]; !ok || !known {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			settings[field] = visibility
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		for field, visibility := range settings {
+			if err := user.SetPrivacy(field, visibility); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		privacy, err := user.Privacy()
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, privacy)
+	})
+}
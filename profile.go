@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+
+	"hacknhbackend.eparker.dev/database"
+)
+
+func registerProfileRoutes() {
+	// Only the fields that are sent change, an empty value clears one. Contacts are replaced as a whole
+	http.HandleFunc("/user/profile/update", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		obj := struct {
+			Major          *string            `json:"major"`
+			GraduationYear *int               `json:"graduationYear"`
+			Pronouns       *string            `json:"pronouns"`
+			Bio            *string            `json:"bio"`
+			Contacts       *map[string]string `json:"contacts"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		fields := user.ProfileFields
+
+		if obj.Major != nil {
+			fields.Major = *obj.Major
+		}
+
+		if obj.GraduationYear != nil {
+			fields.GraduationYear = *obj.GraduationYear
+		}
+
+		if obj.Pronouns != nil {
+			fields.Pronouns = *obj.Pronouns
+		}
+
+		if obj.Bio != nil {
+			fields.Bio = *obj.Bio
+		}
+
+		if obj.Contacts != nil {
+			fields.Contacts = *obj.Contacts
+		}
+
+		if err := user.SetProfileFields(fields); err == database.ErrorInvalidProfile {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(user.JSON())
+	})
+}
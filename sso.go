@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/oidc"
+	"hacknhbackend.eparker.dev/util"
+)
+
+type ssoLogin struct {
+	Verifier, Nonce string
+	Expires         time.Time
+}
+
+// Logins that were started but never came back, past this new ones are turned away until some expire
+const MAX_PENDING_SSO_LOGINS = 10000
+
+var (
+	ssoProvider *oidc.Provider
+	ssoLock     sync.Mutex
+	ssoLogins   map[string]*ssoLogin = make(map[string]*ssoLogin)
+)
+
+// Discovery happens on first use so a flaky identity provider can't keep the server from starting
+func getSSOProvider() (*oidc.Provider, error) {
+	ssoLock.Lock()
+	defer ssoLock.Unlock()
+
+	if ssoProvider != nil {
+		return ssoProvider, nil
+	}
+
+	provider, err := oidc.Discover(util.Config.OIDC.Issuer, util.Config.OIDC.ClientID, util.Config.OIDC.ClientSecret, util.Config.OIDC.RedirectURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ssoProvider = provider
+
+	return ssoProvider, nil
+}
+
+func ssoDomainAllowed(email string) bool {
+	if len(util.Config.OIDC.AllowedDomains) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(email, "@")
+
+	if at == -1 {
+		return false
+	}
+
+	for _, domain := range util.Config.OIDC.AllowedDomains {
+		if strings.EqualFold(email[at+1:], domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func takeSSOLogin(state string) (*ssoLogin, bool) {
+	ssoLock.Lock()
+	defer ssoLock.Unlock()
+
+	login, ok := ssoLogins[state]
+	delete(ssoLogins, state)
+
+	if !ok || time.Now().After(login.Expires) {
+		return nil, false
+	}
+
+	return login, true
+}
+
+func registerSSORoutes() {
+	// Sends the browser off to the identity provider
+	http.HandleFunc("/user/sso/login", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if util.Config.OIDC.Issuer == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		provider, err := getSSOProvider()
+
+		if err != nil {
+			util.Log.Error(fmt.Sprintf("Error discovering identity provider: %v", err))
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		state, nonce := oidc.RandomValue(), oidc.RandomValue()
+		verifier, challenge := oidc.NewPKCE()
+
+		ssoLock.Lock()
+
+		for key, login := range ssoLogins {
+			if time.Now().After(login.Expires) {
+				delete(ssoLogins, key)
+			}
+		}
+
+		if len(ssoLogins) >= MAX_PENDING_SSO_LOGINS {
+			ssoLock.Unlock()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		ssoLogins[state] = &ssoLogin{
+			Verifier: verifier,
+			Nonce:    nonce,
+			Expires:  time.Now().Add(10 * time.Minute),
+		}
+
+		ssoLock.Unlock()
+
+		// Ties the state to this browser so a callback link can't be replayed into someone else's
+		http.SetCookie(w, &http.Cookie{
+			Name:     "sso_state",
+			Value:    state,
+			Path:     "/user/sso",
+			MaxAge:   600,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Secure:   true,
+		})
+
+		http.Redirect(w, r, provider.AuthURL(state, nonce, challenge), http.StatusFound)
+	})
+
+	// The identity provider sends the browser back here
+	http.HandleFunc("/user/sso/callback", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if util.Config.OIDC.Issuer == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		state := query.Get("state")
+		cookie, err := r.Cookie("sso_state")
+
+		if err != nil || state == "" || cookie.Value != state {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     "sso_state",
+			Value:    "",
+			Path:     "/user/sso",
+			MaxAge:   -1,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Secure:   true,
+		})
+
+		login, ok := takeSSOLogin(state)
+
+		if !ok || query.Get("error") != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		provider, err := getSSOProvider()
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		idToken, err := provider.Exchange(query.Get("code"), login.Verifier)
+
+		if err != nil {
+			util.Log.Error(fmt.Sprintf("Error exchanging SSO code: %v", err))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := provider.Verify(idToken, login.Nonce)
+
+		if err != nil {
+			util.Log.Error(fmt.Sprintf("Rejected SSO id token: %v", err))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		email := strings.ToLower(claims.Email)
+
+		// Only link on an address the provider vouches for
+		if !claims.EmailVerified || !database.ValidEmail(email) || !ssoDomainAllowed(email) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		user, err := database.GetUser(email)
+
+		if err != nil {
+			// There's no way to pass an invite through the provider
+			if !database.SignupDomainAllowed(email) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			// First time here, the password is random so only SSO (or a reset) can get in
+			var statusCode int
+			user, statusCode = database.CreateUser(email, claims.GivenName, claims.FamilyName, RandomString(32))
+
+			if statusCode != database.CREATE_USER_SUCCESS {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			util.Log.AddUser(fmt.Sprintf("User %s created through SSO", email))
+		}
+
+		// Whoever registered the unverified account wasn't necessarily this person, lock them out
+		if !user.Verified {
+			if err := claimUnverifiedAccount(user); err != nil {
+				util.Log.Error(fmt.Sprintf("Error claiming %s through SSO: %v", email, err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// The provider stands in for the password, not the second factor. The ticket rides in
+		// the fragment so it never reaches a server log, the page finishes with /user/login
+		if database.TwoFactorEnabled(user.ID) {
+			separator := "#"
+
+			if strings.Contains(util.Config.OIDC.PostLoginURL, "#") {
+				separator = "&"
+			}
+
+			http.Redirect(w, r, util.Config.OIDC.PostLoginURL+separator+"twoFactor="+issueTwoFactorTicket(email), http.StatusFound)
+			return
+		}
+
+		loginSucceeded(email)
+		setSessionCookies(w, email)
+		http.Redirect(w, r, util.Config.OIDC.PostLoginURL, http.StatusFound)
+
+		util.Log.Basic(fmt.Sprintf("User %s logged in through SSO", email))
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/util"
+)
+
+const (
+	MAX_GROUP_NAME        = 100
+	MAX_GROUP_DESCRIPTION = 1000
+	MAX_GROUP_LOCATION    = 200
+	MAX_GROUP_CAPACITY    = 500
+)
+
+func studyGroupJSON(group *database.StudyGroup) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          group.ID,
+		"crn":         group.CRN,
+		"subject":     group.Subject,
+		"number":      group.Number,
+		"name":        group.Name,
+		"description": group.Description,
+		"location":    group.Location,
+		"capacity":    group.Capacity,
+		"members":     group.Members,
+		"role":        group.Role,
+		"created":     group.CreatedAt.Unix(),
+	}
+}
+
+func studyGroupsJSON(groups []database.StudyGroup) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(groups))
+
+	for i := range groups {
+		list = append(list, studyGroupJSON(&groups[i]))
+	}
+
+	return list
+}
+
+// Groups are only for people taking the course they're attached to
+func canJoinStudyGroup(user *database.User, group *database.StudyGroup) bool {
+	if group.CRN != "" {
+		return user.EnrolledIn(group.CRN)
+	}
+
+	return user.Takes(group.Subject, group.Number)
+}
+
+// The logged in user and the group named by {"id": ...} in the body
+func studyGroupRequest(w http.ResponseWriter, r *http.Request) (*database.User, *database.StudyGroup, bool) {
+	obj := struct {
+		ID int `json:"id"`
+	}{}
+
+	if !readJSON(w, r, &obj) {
+		return nil, nil, false
+	}
+
+	email, _ := r.Cookie("email")
+	user, err := database.GetUser(email.Value)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	group, err := database.GetStudyGroup(obj.ID, user.ID)
+
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil, false
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	return user, group, true
+}
+
+func registerStudyGroupRoutes() {
+	// Attach with either "crn" for one section or "subject" + "number" for every section
+	http.HandleFunc("/group/create", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			CRN         string `json:"crn"`
+			Subject     string `json:"subject"`
+			Number      string `json:"number"`
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			Location    string `json:"location"`
+			Capacity    int    `json:"capacity"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		group := database.StudyGroup{
+			CRN:         strings.TrimSpace(obj.CRN),
+			Subject:     strings.ToUpper(strings.TrimSpace(obj.Subject)),
+			Number:      strings.ToUpper(strings.TrimSpace(obj.Number)),
+			Name:        strings.TrimSpace(obj.Name),
+			Description: strings.TrimSpace(obj.Description),
+			Location:    strings.TrimSpace(obj.Location),
+			Capacity:    obj.Capacity,
+		}
+
+		forSection := group.CRN != "" && group.Subject == "" && group.Number == ""
+		forCourse := group.CRN == "" && group.Subject != "" && group.Number != ""
+
+		if (!forSection && !forCourse) || group.Name == "" || len(group.Name) > MAX_GROUP_NAME || len(group.Description) > MAX_GROUP_DESCRIPTION ||
+			len(group.Location) > MAX_GROUP_LOCATION || group.Capacity < 0 || group.Capacity > MAX_GROUP_CAPACITY || group.Capacity == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !canJoinStudyGroup(user, &group) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		created, err := database.CreateStudyGroup(user.ID, group)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, studyGroupJSON(created))
+
+		util.Log.Basic(fmt.Sprintf("User %s created study group %d", user.Email, created.ID))
+	})
+
+	// The group and, for people in it, who else is
+	http.HandleFunc("/group/get", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		user, group, ok := studyGroupRequest(w, r)
+
+		if !ok {
+			return
+		}
+
+		obj := studyGroupJSON(group)
+
+		if group.Role != "" || user.Can(database.PERMISSION_MODERATE) {
+			members, roles, err := database.StudyGroupMembers(group.ID)
+
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			list := make([]map[string]interface{}, 0, len(members))
+
+			for i := range members {
+				list = append(list, map[string]interface{}{
+					"profile": members[i].Profile(user),
+					"role":    roles[i],
+				})
+			}
+
+			obj["memberList"] = list
+		}
+
+		writeJSON(w, obj)
+	})
+
+	http.HandleFunc("/group/join", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		user, group, ok := studyGroupRequest(w, r)
+
+		if !ok {
+			return
+		}
+
+		if !canJoinStudyGroup(user, group) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch err := database.JoinStudyGroup(group.ID, user.ID); err {
+		case nil:
+			w.WriteHeader(http.StatusOK)
+		case database.ErrorAlreadyMember, database.ErrorGroupFull:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	// An owner leaving hands the group to the longest standing member
+	http.HandleFunc("/group/leave", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		user, group, ok := studyGroupRequest(w, r)
+
+		if !ok {
+			return
+		}
+
+		switch err := database.LeaveStudyGroup(group.ID, user.ID); err {
+		case nil:
+			w.WriteHeader(http.StatusOK)
+		case database.ErrorNotMember:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	// Owners can delete their groups, moderators can delete anyone's
+	http.HandleFunc("/group/delete", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		user, group, ok := studyGroupRequest(w, r)
+
+		if !ok {
+			return
+		}
+
+		if group.Role != database.GROUP_ROLE_OWNER && !user.Can(database.PERMISSION_MODERATE) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if err := database.DeleteStudyGroup(group.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		util.Log.Basic(fmt.Sprintf("User %s deleted study group %d", user.Email, group.ID))
+	})
+
+	// Groups for a section, including the ones for every section of its course
+	http.HandleFunc("/course/groups", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			CRN     string `json:"crn"`
+			Subject string `json:"subject"`
+			Number  string `json:"number"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		subject, number := strings.ToUpper(obj.Subject), strings.ToUpper(obj.Number)
+
+		if obj.CRN != "" {
+			course, err := database.GetCourse(obj.CRN)
+
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			subject, number = course.Data.Subject, course.Data.Number
+		} else if subject == "" || number == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		groups, err := database.CourseStudyGroups(obj.CRN, subject, number, user.ID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, studyGroupsJSON(groups))
+	})
+
+	http.HandleFunc("/user/groups", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		groups, err := database.UserStudyGroups(user.ID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, studyGroupsJSON(groups))
+	})
+}
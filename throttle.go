@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hacknhbackend.eparker.dev/util"
+)
+
+var loginAccountThrottle, loginIPThrottle *util.Throttle
+
+func initLoginThrottles() {
+	loginAccountThrottle = util.NewThrottle(util.Config.Auth.LoginFreeAttempts, util.Config.Auth.LoginBaseLockout, util.Config.Auth.LoginMaxLockout)
+
+	// Lots of students share a campus IP, so it gets more room
+	loginIPThrottle = util.NewThrottle(util.Config.Auth.LoginIPFreeAttempts, util.Config.Auth.LoginBaseLockout, util.Config.Auth.LoginMaxLockout)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// Responds 429 if either the account or the IP is locked out
+func loginThrottled(w http.ResponseWriter, r *http.Request, email string) bool {
+	wait := max(loginAccountThrottle.Wait(email), loginIPThrottle.Wait(clientIP(r)))
+
+	if wait > 0 {
+		tooManyRequests(w, wait)
+		return true
+	}
+
+	return false
+}
+
+func loginFailed(r *http.Request, email string) {
+	ip := clientIP(r)
+
+	if lockout := loginAccountThrottle.Fail(email); lockout > 0 {
+		util.Log.Important(fmt.Sprintf("Login for %s locked for %v (last attempt from %s)", email, lockout, ip))
+	}
+
+	if lockout := loginIPThrottle.Fail(ip); lockout > 0 {
+		util.Log.Important(fmt.Sprintf("Logins from %s locked for %v", ip, lockout))
+	}
+}
+
+// Only the account is reset, otherwise an attacker could clear their
+// IP's count by logging into an account of their own
+func loginSucceeded(email string) {
+	loginAccountThrottle.Reset(email)
+	cancelAccountDeletion(email)
+}
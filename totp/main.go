@@ -0,0 +1,100 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/**
+ * RFC 6238 time-based one-time passwords with the
+ * defaults every authenticator app understands:
+ * SHA1, 6 digits, 30 second steps
+ */
+
+const (
+	Digits = 6
+	Period = 30
+
+	// Steps either side of now that are still accepted
+	Window = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func NewSecret() (string, error) {
+	bytes := make([]byte, 20)
+
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(bytes), nil
+}
+
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+func codeAt(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%1000000)
+}
+
+func Code(secret string, t time.Time) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	return codeAt(key, Step(t)), nil
+}
+
+// Returns the step the code matched so callers can refuse to accept it twice
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != Digits {
+		return 0, false
+	}
+
+	now := Step(t)
+
+	for step := now - Window; step <= now+Window; step++ {
+		if subtle.ConstantTimeCompare([]byte(codeAt(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// The otpauth:// URI authenticator apps scan as a QR code
+func ProvisioningURI(secret, issuer, account string) string {
+	values := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(Period)},
+	}
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
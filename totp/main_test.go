@@ -0,0 +1,63 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The RFC 6238 SHA1 secret, "12345678901234567890", in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 appendix B, cut down to the last six of the eight digits given there
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestRFC6238Vectors(t *testing.T) {
+	for _, vector := range rfcVectors {
+		code, err := Code(rfcSecret, time.Unix(vector.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != vector.code {
+			t.Errorf("at %d: got %s, want %s", vector.unix, code, vector.code)
+		}
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	for offset, ok := range map[time.Duration]bool{-2 * Period: false, -Period: true, 0: true, Period: true, 2 * Period: false} {
+		code, _ := Code(rfcSecret, now.Add(offset*time.Second))
+		step, valid := Validate(rfcSecret, code, now)
+
+		if valid != ok {
+			t.Errorf("code from %ds away: valid = %v, want %v", offset, valid, ok)
+		}
+
+		if valid && step != Step(now.Add(offset*time.Second)) {
+			t.Errorf("code from %ds away matched step %d", offset, step)
+		}
+	}
+
+	if _, valid := Validate(strings.ToLower(rfcSecret), "050471", now); !valid {
+		t.Error("lowercase secret rejected")
+	}
+
+	for _, code := range []string{"", "05047", "0504711", "000000"} {
+		if _, valid := Validate(rfcSecret, code, now); valid {
+			t.Errorf("accepted %q", code)
+		}
+	}
+}
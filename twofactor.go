@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/mailer"
+	"hacknhbackend.eparker.dev/totp"
+	"hacknhbackend.eparker.dev/util"
+)
+
+const TOTP_ISSUER = "Classly"
+
+// Handed out after the password step, traded for a session with a valid code
+type twoFactorTicket struct {
+	Email    string
+	Attempts int
+	Expires  time.Time
+}
+
+var (
+	twoFactorTickets map[string]*twoFactorTicket = make(map[string]*twoFactorTicket)
+	twoFactorLock    sync.Mutex
+)
+
+func issueTwoFactorTicket(email string) string {
+	ticket := RandomString(32)
+
+	twoFactorLock.Lock()
+
+	for key, t := range twoFactorTickets {
+		if time.Now().After(t.Expires) {
+			delete(twoFactorTickets, key)
+		}
+	}
+
+	twoFactorTickets[ticket] = &twoFactorTicket{
+		Email:   email,
+		Expires: time.Now().Add(5 * time.Minute),
+	}
+
+	twoFactorLock.Unlock()
+
+	return ticket
+}
+
+func startTwoFactorLogin(w http.ResponseWriter, email string) {
+	ticket := issueTwoFactorTicket(email)
+
+	if jsonTicket, err := json.Marshal(map[string]interface{}{"twoFactor": true, "ticket": ticket}); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(jsonTicket)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// Accepts either a code from the authenticator app or an unused recovery code
+func checkSecondFactor(user *database.User, code string) bool {
+	t, err := database.GetTOTP(user.ID)
+
+	if err != nil || !t.Enabled {
+		return false
+	}
+
+	if step, ok := totp.Validate(t.Secret, code, time.Now()); ok {
+		return database.UseTOTPStep(user.ID, step)
+	}
+
+	return database.UseRecoveryCode(user.ID, code)
+}
+
+func finishTwoFactorLogin(w http.ResponseWriter, r *http.Request, ticket, code string) {
+	twoFactorLock.Lock()
+	t, ok := twoFactorTickets[ticket]
+
+	if ok && time.Now().After(t.Expires) {
+		delete(twoFactorTickets, ticket)
+		ok = false
+	}
+
+	twoFactorLock.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if loginThrottled(w, r, t.Email) {
+		return
+	}
+
+	user, err := database.GetUser(t.Email)
+
+	if err != nil || !checkSecondFactor(user, code) {
+		loginFailed(r, t.Email)
+
+		// A handful of guesses per ticket, then back to the password
+		twoFactorLock.Lock()
+		if t.Attempts++; t.Attempts >= 5 {
+			delete(twoFactorTickets, ticket)
+		}
+		twoFactorLock.Unlock()
+
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	twoFactorLock.Lock()
+	delete(twoFactorTickets, ticket)
+	twoFactorLock.Unlock()
+
+	loginSucceeded(t.Email)
+	setSessionCookies(w, t.Email)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	if jsonCodes, err := json.Marshal(map[string][]string{"recoveryCodes": codes}); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonCodes)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func registerTwoFactorRoutes() {
+	// Start setting up an authenticator app, nothing changes until it's confirmed
+	http.HandleFunc("/user/2fa/enroll", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			Password string `json:"password"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !user.CheckPassword(obj.Password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if database.TwoFactorEnabled(user.ID) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		secret, err := totp.NewSecret()
+
+		if err != nil || database.SetPendingTOTP(user.ID, secret) != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if jsonSecret, err := json.Marshal(map[string]string{
+			"secret": secret,
+			"uri":    totp.ProvisioningURI(secret, TOTP_ISSUER, user.Email),
+		}); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonSecret)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	// Confirm the app works by sending a code, turns 2FA on and returns recovery codes
+	http.HandleFunc("/user/2fa/confirm", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			Code string `json:"code"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		t, err := database.GetTOTP(user.ID)
+
+		if err != nil || t.Enabled {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		step, ok := totp.Validate(t.Secret, obj.Code, time.Now())
+
+		if !ok || !database.UseTOTPStep(user.ID, step) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := database.EnableTOTP(user.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		codes, err := database.CreateRecoveryCodes(user.ID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeRecoveryCodes(w, codes)
+
+		mailer.SendAsync(mailer.Message{
+			To:      user.Email,
+			Subject: "Two-factor authentication turned on",
+			Body:    fmt.Sprintf("Hi %s,\n\nTwo-factor authentication was just turned on for your account. If this wasn't you, reset your password right away.\n", user.FirstName),
+		})
+
+		util.Log.Basic(fmt.Sprintf("User %s turned on two-factor authentication", user.Email))
+	})
+
+	// Swap the recovery codes for a fresh set
+	http.HandleFunc("/user/2fa/recovery", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		obj := struct {
+			Code string `json:"code"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !checkSecondFactor(user, obj.Code) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		codes, err := database.CreateRecoveryCodes(user.ID)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeRecoveryCodes(w, codes)
+	})
+
+	// Turn 2FA off, needs both the password and a code
+	http.HandleFunc("/user/2fa/disable", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		obj := struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !user.CheckPassword(obj.Password) || !checkSecondFactor(user, obj.Code) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := database.DisableTOTP(user.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		mailer.SendAsync(mailer.Message{
+			To:      user.Email,
+			Subject: "Two-factor authentication turned off",
+			Body:    fmt.Sprintf("Hi %s,\n\nTwo-factor authentication was just turned off for your account. If this wasn't you, reset your password right away.\n", user.FirstName),
+		})
+
+		util.Log.Basic(fmt.Sprintf("User %s turned off two-factor authentication", user.Email))
+	})
+}
@@ -2,9 +2,12 @@ package util
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lpernett/godotenv"
 )
@@ -13,11 +16,13 @@ var Config struct {
 	Database struct {
 		FileName, PasswordSalt string
 		QueueSize              int
+		AutoMigrate            bool
 	}
 
 	Server struct {
-		Host, TLS string
-		Port      int
+		Host, TLS, PublicURL string
+		AllowedOrigins       []string
+		Port                 int
 	}
 
 	General struct {
@@ -27,6 +32,46 @@ var Config struct {
 	Mapbox struct {
 		AccessToken string
 	}
+
+	Mail struct {
+		From, SMTPHost, SMTPUsername, SMTPPassword, OutboxDirectory string
+		SMTPPort                                                    int
+	}
+
+	Auth struct {
+		PasswordResetLifetime, VerificationLifetime time.Duration
+		MagicLinkLifetime                           time.Duration
+		MagicLinks                                  bool
+		DeletionGracePeriod                         time.Duration
+		LoginBaseLockout, LoginMaxLockout           time.Duration
+		LoginFreeAttempts, LoginIPFreeAttempts      int
+		AdminEmails                                 []string
+	}
+
+	Signup struct {
+		AllowedDomains []string
+		RequireInvite  bool
+	}
+
+	Webhooks struct {
+		AllowPrivate bool
+		MaxAttempts  int
+		Timeout      time.Duration
+	}
+
+	Exports struct {
+		LinkLifetime time.Duration
+	}
+
+	WebAuthn struct {
+		RPID, RPName string
+		Origins      []string
+	}
+
+	OIDC struct {
+		Issuer, ClientID, ClientSecret, RedirectURL, PostLoginURL string
+		AllowedDomains                                            []string
+	}
 }
 
 func LoadEnvFile() {
@@ -60,11 +105,45 @@ func LoadEnvFile() {
 				file.WriteString("DATABASE_FILE_NAME=\n")
 				file.WriteString("DATABASE_QUEUE_SIZE=\n")
 				file.WriteString("DATABASE_PASSWORD_SALT=\n")
+				file.WriteString("DATABASE_AUTO_MIGRATE=\n")
 				file.WriteString("SERVER_HOST=\n")
 				file.WriteString("SERVER_PORT=\n")
 				file.WriteString("GENERAL_UPDATE_COURSES=\n")
 				file.WriteString("MAPBOX_ACCESS_TOKEN=\n")
 				file.WriteString("TLS_DIRECTORY=\n")
+				file.WriteString("SERVER_PUBLIC_URL=\n")
+				file.WriteString("SERVER_ALLOWED_ORIGINS=\n")
+				file.WriteString("MAIL_FROM=\n")
+				file.WriteString("MAIL_SMTP_HOST=\n")
+				file.WriteString("MAIL_SMTP_PORT=\n")
+				file.WriteString("MAIL_SMTP_USERNAME=\n")
+				file.WriteString("MAIL_SMTP_PASSWORD=\n")
+				file.WriteString("MAIL_OUTBOX_DIRECTORY=\n")
+				file.WriteString("AUTH_PASSWORD_RESET_LIFETIME=\n")
+				file.WriteString("AUTH_VERIFICATION_LIFETIME=\n")
+				file.WriteString("AUTH_LOGIN_FREE_ATTEMPTS=\n")
+				file.WriteString("AUTH_LOGIN_IP_FREE_ATTEMPTS=\n")
+				file.WriteString("AUTH_LOGIN_BASE_LOCKOUT=\n")
+				file.WriteString("AUTH_LOGIN_MAX_LOCKOUT=\n")
+				file.WriteString("AUTH_ADMIN_EMAILS=\n")
+				file.WriteString("AUTH_MAGIC_LINKS=\n")
+				file.WriteString("AUTH_MAGIC_LINK_LIFETIME=\n")
+				file.WriteString("AUTH_DELETION_GRACE_PERIOD=\n")
+				file.WriteString("SIGNUP_ALLOWED_DOMAINS=\n")
+				file.WriteString("SIGNUP_REQUIRE_INVITE=\n")
+				file.WriteString("WEBHOOKS_ALLOW_PRIVATE=\n")
+				file.WriteString("WEBHOOKS_MAX_ATTEMPTS=\n")
+				file.WriteString("WEBHOOKS_TIMEOUT=\n")
+				file.WriteString("EXPORTS_LINK_LIFETIME=\n")
+				file.WriteString("WEBAUTHN_RP_ID=\n")
+				file.WriteString("WEBAUTHN_RP_NAME=\n")
+				file.WriteString("WEBAUTHN_ORIGINS=\n")
+				file.WriteString("OIDC_ISSUER=\n")
+				file.WriteString("OIDC_CLIENT_ID=\n")
+				file.WriteString("OIDC_CLIENT_SECRET=\n")
+				file.WriteString("OIDC_REDIRECT_URL=\n")
+				file.WriteString("OIDC_POST_LOGIN_URL=\n")
+				file.WriteString("OIDC_ALLOWED_DOMAINS=\n")
 
 				file.Close()
 
@@ -111,6 +190,9 @@ func LoadEnvFile() {
 		Config.Database.PasswordSalt = tmp.(string)
 	}
 
+	// Turn off to only ever migrate with the "migrate" command
+	Config.Database.AutoMigrate = optionalBoolEnv("DATABASE_AUTO_MIGRATE", true)
+
 	if tmp = os.Getenv("SERVER_HOST"); tmp == "" {
 		Log.Error("SERVER_HOST not set (string)")
 		os.Exit(1)
@@ -160,5 +242,152 @@ func LoadEnvFile() {
 		Config.Server.TLS = tmp.(string)
 	}
 
+	// Optional settings, these all have sensible defaults
+	if Config.Server.TLS != "" {
+		Config.Server.PublicURL = optionalEnv("SERVER_PUBLIC_URL", fmt.Sprintf("https://%s:%d", Config.Server.Host, Config.Server.Port))
+	} else {
+		Config.Server.PublicURL = optionalEnv("SERVER_PUBLIC_URL", fmt.Sprintf("http://%s:%d", Config.Server.Host, Config.Server.Port))
+	}
+
+	publicURL, err := url.Parse(Config.Server.PublicURL)
+
+	if err != nil || publicURL.Scheme == "" || publicURL.Host == "" {
+		Log.Error("SERVER_PUBLIC_URL not a valid URL")
+		os.Exit(1)
+	}
+
+	// Browsers on these origins may make credentialed requests, defaults to the public URL's origin
+	Config.Server.AllowedOrigins = optionalListEnv("SERVER_ALLOWED_ORIGINS")
+
+	if len(Config.Server.AllowedOrigins) == 0 {
+		Config.Server.AllowedOrigins = []string{strings.ToLower(publicURL.Scheme + "://" + publicURL.Host)}
+	}
+
+	Config.Mail.From = optionalEnv("MAIL_FROM", "classly@localhost")
+	Config.Mail.SMTPHost = optionalEnv("MAIL_SMTP_HOST", "")
+	Config.Mail.SMTPPort = optionalIntEnv("MAIL_SMTP_PORT", 587)
+	Config.Mail.SMTPUsername = optionalEnv("MAIL_SMTP_USERNAME", "")
+	Config.Mail.SMTPPassword = optionalEnv("MAIL_SMTP_PASSWORD", "")
+	Config.Mail.OutboxDirectory = optionalEnv("MAIL_OUTBOX_DIRECTORY", "outbox")
+
+	Config.Auth.PasswordResetLifetime = optionalDurationEnv("AUTH_PASSWORD_RESET_LIFETIME", time.Hour)
+	Config.Auth.VerificationLifetime = optionalDurationEnv("AUTH_VERIFICATION_LIFETIME", 48*time.Hour)
+	Config.Auth.LoginFreeAttempts = optionalIntEnv("AUTH_LOGIN_FREE_ATTEMPTS", 5)
+	Config.Auth.LoginIPFreeAttempts = optionalIntEnv("AUTH_LOGIN_IP_FREE_ATTEMPTS", 20)
+	Config.Auth.LoginBaseLockout = optionalDurationEnv("AUTH_LOGIN_BASE_LOCKOUT", 30*time.Second)
+	Config.Auth.LoginMaxLockout = optionalDurationEnv("AUTH_LOGIN_MAX_LOCKOUT", time.Hour)
+	Config.Auth.AdminEmails = optionalListEnv("AUTH_ADMIN_EMAILS")
+	Config.Auth.MagicLinks = optionalBoolEnv("AUTH_MAGIC_LINKS", true)
+	Config.Auth.MagicLinkLifetime = optionalDurationEnv("AUTH_MAGIC_LINK_LIFETIME", 15*time.Minute)
+
+	// Deleted accounts hang around this long, logging in again cancels the deletion
+	Config.Auth.DeletionGracePeriod = optionalDurationEnv("AUTH_DELETION_GRACE_PERIOD", 14*24*time.Hour)
+
+	// Anyone can sign up unless these say otherwise, an invite gets around the domain list
+	Config.Signup.AllowedDomains = optionalListEnv("SIGNUP_ALLOWED_DOMAINS")
+	Config.Signup.RequireInvite = optionalBoolEnv("SIGNUP_REQUIRE_INVITE", false)
+
+	// Webhooks can't reach loopback or private addresses unless allowed, say for a local receiver
+	Config.Webhooks.AllowPrivate = optionalBoolEnv("WEBHOOKS_ALLOW_PRIVATE", false)
+	Config.Webhooks.MaxAttempts = optionalIntEnv("WEBHOOKS_MAX_ATTEMPTS", 8)
+	Config.Webhooks.Timeout = optionalDurationEnv("WEBHOOKS_TIMEOUT", 10*time.Second)
+
+	// Finished exports can be downloaded once within this long, then they're thrown away
+	Config.Exports.LinkLifetime = optionalDurationEnv("EXPORTS_LINK_LIFETIME", 24*time.Hour)
+
+	// Passkeys are bound to a domain, by default the public URL's
+	Config.WebAuthn.RPID = optionalEnv("WEBAUTHN_RP_ID", publicURL.Hostname())
+	Config.WebAuthn.RPName = optionalEnv("WEBAUTHN_RP_NAME", "Classly")
+	Config.WebAuthn.Origins = optionalListEnv("WEBAUTHN_ORIGINS")
+
+	if len(Config.WebAuthn.Origins) == 0 {
+		Config.WebAuthn.Origins = Config.Server.AllowedOrigins
+	}
+
+	// Single sign-on is off unless an issuer is set
+	Config.OIDC.Issuer = optionalEnv("OIDC_ISSUER", "")
+	Config.OIDC.ClientID = optionalEnv("OIDC_CLIENT_ID", "")
+	Config.OIDC.ClientSecret = optionalEnv("OIDC_CLIENT_SECRET", "")
+	Config.OIDC.RedirectURL = optionalEnv("OIDC_REDIRECT_URL", Config.Server.PublicURL+"/user/sso/callback")
+	Config.OIDC.PostLoginURL = optionalEnv("OIDC_POST_LOGIN_URL", Config.Server.PublicURL+"/")
+	Config.OIDC.AllowedDomains = optionalListEnv("OIDC_ALLOWED_DOMAINS")
+
+	if Config.OIDC.Issuer != "" && Config.OIDC.ClientID == "" {
+		Log.Error("OIDC_CLIENT_ID not set (string), required when OIDC_ISSUER is set")
+		os.Exit(1)
+	}
+
 	Log.Status("Loaded environment variables")
 }
+
+func optionalEnv(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// Comma separated, lowercased, empty entries dropped
+func optionalListEnv(name string) []string {
+	list := make([]string, 0)
+
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+			list = append(list, value)
+		}
+	}
+
+	return list
+}
+
+func optionalIntEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+
+	if value == "" {
+		return fallback
+	}
+
+	i, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil {
+		Log.Error(fmt.Sprintf("%s not an integer", name))
+		os.Exit(1)
+	}
+
+	return int(i)
+}
+
+func optionalBoolEnv(name string, fallback bool) bool {
+	value := os.Getenv(name)
+
+	if value == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+
+	if err != nil {
+		Log.Error(fmt.Sprintf("%s not a truthy value", name))
+		os.Exit(1)
+	}
+
+	return b
+}
+
+func optionalDurationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+
+	if err != nil {
+		Log.Error(fmt.Sprintf("%s not a duration (e.g. 30m, 24h)", name))
+		os.Exit(1)
+	}
+
+	return d
+}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+ * Tracks failed attempts per key (an email, an IP, ...)
+ * and backs off exponentially once the free attempts
+ * are used up, capped at Max
+ */
+
+type Throttle struct {
+	Free      int
+	Base, Max time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*throttleEntry
+	swept   time.Time
+}
+
+type throttleEntry struct {
+	failures    int
+	last, until time.Time
+}
+
+func NewThrottle(free int, base, max time.Duration) *Throttle {
+	return &Throttle{
+		Free:    free,
+		Base:    base,
+		Max:     max,
+		entries: make(map[string]*throttleEntry),
+	}
+}
+
+// Entries are forgotten once they've been quiet for a full lockout
+func (t *Throttle) expired(entry *throttleEntry, now time.Time) bool {
+	return now.Sub(entry.last) > t.Max && now.After(entry.until)
+}
+
+// How long the key has to wait before its next attempt, 0 if it can go now
+func (t *Throttle) Wait(key string) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entry, ok := t.entries[key]
+
+	if !ok || time.Now().After(entry.until) {
+		return 0
+	}
+
+	return time.Until(entry.until)
+}
+
+// Records a failure and returns the lockout it caused, 0 if none
+func (t *Throttle) Fail(key string) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+
+	// Sweeping is a pass over every key, so only once per lockout period rather than every failure
+	if now.Sub(t.swept) > t.Max {
+		for k, entry := range t.entries {
+			if t.expired(entry, now) {
+				delete(t.entries, k)
+			}
+		}
+
+		t.swept = now
+	}
+
+	entry, ok := t.entries[key]
+
+	// Quiet long enough to be forgotten, even if the sweep hasn't got to it yet
+	if !ok || t.expired(entry, now) {
+		entry = &throttleEntry{}
+		t.entries[key] = entry
+	}
+
+	entry.failures++
+	entry.last = now
+
+	if entry.failures <= t.Free {
+		return 0
+	}
+
+	lockout := t.Base
+
+	for i := t.Free + 1; i < entry.failures && lockout < t.Max; i++ {
+		lockout *= 2
+	}
+
+	if lockout > t.Max {
+		lockout = t.Max
+	}
+
+	entry.until = now.Add(lockout)
+
+	return lockout
+}
+
+func (t *Throttle) Reset(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.entries, key)
+}
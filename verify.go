@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/mailer"
+	"hacknhbackend.eparker.dev/util"
+)
+
+var verifyResendThrottle *util.Throttle
+
+// Every resend counts, so nobody can flood an inbox with verification emails
+func initVerifyThrottle() {
+	verifyResendThrottle = util.NewThrottle(3, time.Minute, time.Hour)
+}
+
+// Replaces any outstanding verification link with a fresh one
+func sendVerificationEmail(user *database.User) {
+	database.RevokeOneTimeTokens(user.ID, database.TOKEN_PURPOSE_EMAIL_VERIFICATION)
+
+	token, err := database.CreateOneTimeToken(user.ID, database.TOKEN_PURPOSE_EMAIL_VERIFICATION, user.Email, util.Config.Auth.VerificationLifetime)
+
+	if err != nil {
+		util.Log.Error(fmt.Sprintf("Error creating verification token for %s: %v", user.Email, err))
+		return
+	}
+
+	mailer.SendAsync(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm this is your email address by following this link within %v:\n\n%s/verify?token=%s\n\nIf you didn't create an account, you can ignore this email.\n",
+			user.FirstName, util.Config.Auth.VerificationLifetime, util.Config.Server.PublicURL, url.QueryEscape(token)),
+	})
+}
+
+/**
+ * Proving the address some other way than the verification link, like
+ * through SSO, means whoever registered the account first wasn't
+ * necessarily this person. Nothing they set up survives: the password
+ * is randomized, sessions end and passkeys and two-factor are removed
+ */
+func claimUnverifiedAccount(user *database.User) error {
+	if err := user.SetPassword(RandomString(32)); err != nil {
+		return err
+	}
+
+	if err := user.ForgetCredentials(); err != nil {
+		return err
+	}
+
+	RevokeTokens(user.Email)
+
+	if err := user.MarkVerified(); err != nil {
+		return err
+	}
+
+	database.PromoteAdmins(util.Config.Auth.AdminEmails)
+
+	return nil
+}
+
+// Like withAuth, but the account's email also has to be verified
+func withVerified(w http.ResponseWriter, r *http.Request) bool {
+	if !withAuth(w, r) {
+		return false
+	}
+
+	email, _ := r.Cookie("email")
+	user, err := database.GetUser(email.Value)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+
+	if !user.Verified {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func registerVerifyRoutes() {
+	// Verify email with a token from the verification email
+	http.HandleFunc("/user/verify", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		obj := struct {
+			Token string `json:"token"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		token, err := database.ConsumeOneTimeToken(database.TOKEN_PURPOSE_EMAIL_VERIFICATION, obj.Token)
+
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := database.GetUserByID(token.UserID)
+
+		// The link was sent to an address the account no longer uses
+		if err != nil || user.Email != token.Email {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := user.MarkVerified(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		database.PromoteAdmins(util.Config.Auth.AdminEmails)
+
+		w.WriteHeader(http.StatusOK)
+
+		util.Log.Basic(fmt.Sprintf("User %s verified their email", user.Email))
+	})
+
+	// Send a new verification email
+	http.HandleFunc("/user/verify/resend", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withAuth(w, r) {
+			return
+		}
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if user.Verified {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		if wait := verifyResendThrottle.Wait(user.Email); wait > 0 {
+			tooManyRequests(w, wait)
+			return
+		}
+
+		verifyResendThrottle.Fail(user.Email)
+
+		sendVerificationEmail(user)
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
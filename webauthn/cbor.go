@@ -0,0 +1,134 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/**
+ * A small CBOR decoder, only what attestation objects
+ * and COSE keys use: integers, byte/text strings,
+ * arrays, maps and the simple values
+ */
+
+const maxDepth = 16
+
+// Decodes one item and returns whatever bytes follow it
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeItem(data, 0)
+}
+
+func readLength(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+
+	return 0, nil, fmt.Errorf("cbor: bad length")
+}
+
+func decodeItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxDepth {
+		return nil, nil, fmt.Errorf("cbor: nested too deep")
+	}
+
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("cbor: unexpected end")
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+
+	// Simple values and floats don't use the length encoding
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data[1:], nil
+		case 21:
+			return true, data[1:], nil
+		case 22, 23:
+			return nil, data[1:], nil
+		}
+
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+
+	n, rest, err := readLength(info, data[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		return int64(n), rest, nil
+	case 1:
+		return -1 - int64(n), rest, nil
+	case 2, 3:
+		if uint64(len(rest)) < n {
+			return nil, nil, fmt.Errorf("cbor: string runs past the end")
+		}
+
+		if major == 2 {
+			return rest[:n], rest[n:], nil
+		}
+
+		return string(rest[:n]), rest[n:], nil
+	case 4:
+		if n > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("cbor: array runs past the end")
+		}
+
+		array := make([]interface{}, 0, n)
+
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+
+			if item, rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			array = append(array, item)
+		}
+
+		return array, rest, nil
+	case 5:
+		if n > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("cbor: map runs past the end")
+		}
+
+		m := make(map[interface{}]interface{}, n)
+
+		for i := uint64(0); i < n; i++ {
+			var key, value interface{}
+
+			if key, rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			if value, rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+				m[key] = value
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key")
+			}
+		}
+
+		return m, rest, nil
+	case 6:
+		// Tags are ignored, the tagged item is returned as is
+		return decodeItem(rest, depth+1)
+	}
+
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
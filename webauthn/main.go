@@ -0,0 +1,273 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+/**
+ * Server side of WebAuthn for passkeys. Attestation is
+ * requested as "none", so registration only checks the
+ * client data and authenticator data, not who made the
+ * authenticator
+ */
+
+type RelyingParty struct {
+	ID      string
+	Origins []string
+}
+
+type Credential struct {
+	ID, PublicKey []byte
+	SignCount     uint32
+}
+
+const (
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+)
+
+// COSE algorithm identifiers we accept
+const (
+	ALG_ES256 = -7
+	ALG_RS256 = -257
+)
+
+var Encoding = base64.RawURLEncoding
+
+func NewChallenge() []byte {
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+	return challenge
+}
+
+func (rp *RelyingParty) checkClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	clientData := struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}{}
+
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return err
+	}
+
+	if clientData.Type != ceremony {
+		return fmt.Errorf("client data is for %q, not %q", clientData.Type, ceremony)
+	}
+
+	sent, err := Encoding.DecodeString(clientData.Challenge)
+
+	if err != nil || subtle.ConstantTimeCompare(sent, challenge) != 1 {
+		return fmt.Errorf("challenge doesn't match")
+	}
+
+	for _, origin := range rp.Origins {
+		if clientData.Origin == origin {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("origin %q isn't allowed", clientData.Origin)
+}
+
+type authenticatorData struct {
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func (rp *RelyingParty) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("authenticator data too short")
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return nil, fmt.Errorf("authenticator data is for another relying party")
+	}
+
+	parsed := &authenticatorData{
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if parsed.Flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("user wasn't present")
+	}
+
+	if parsed.Flags&flagAttestedData == 0 {
+		return parsed, nil
+	}
+
+	// aaguid (16) + credential id length (2) + credential id + COSE key
+	rest := data[37:]
+
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("attested credential data too short")
+	}
+
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+
+	if len(rest) < idLength {
+		return nil, fmt.Errorf("credential id runs past the end")
+	}
+
+	parsed.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed.PublicKey = rest[:len(rest)-len(after)]
+
+	return parsed, nil
+}
+
+// Checks a navigator.credentials.create() response and returns the new credential
+func (rp *RelyingParty) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte) (*Credential, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("attestation object isn't a map")
+	}
+
+	authData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("attestation object has no authenticator data")
+	}
+
+	parsed, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.CredentialID == nil {
+		return nil, fmt.Errorf("no credential was created")
+	}
+
+	// Make sure we'll be able to verify with it later
+	if _, _, err := parsePublicKey(parsed.PublicKey); err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        parsed.CredentialID,
+		PublicKey: parsed.PublicKey,
+		SignCount: parsed.SignCount,
+	}, nil
+}
+
+// Checks a navigator.credentials.get() response against a stored credential, returns the new sign count
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, credential *Credential, clientDataJSON, authData, signature []byte) (uint32, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	parsed, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+
+	algorithm, key, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	hash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	switch algorithm {
+	case ALG_ES256:
+		if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), hash[:], signature) {
+			return 0, fmt.Errorf("bad signature")
+		}
+	case ALG_RS256:
+		if rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], signature) != nil {
+			return 0, fmt.Errorf("bad signature")
+		}
+	}
+
+	// Authenticators that count should only ever count up, otherwise it's been cloned
+	if (parsed.SignCount != 0 || credential.SignCount != 0) && parsed.SignCount <= credential.SignCount {
+		return 0, fmt.Errorf("sign count went backwards, credential may be cloned")
+	}
+
+	return parsed.SignCount, nil
+}
+
+func parsePublicKey(cose []byte) (int64, interface{}, error) {
+	decoded, _, err := decodeCBOR(cose)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, fmt.Errorf("public key isn't a COSE key")
+	}
+
+	keyType, _ := key[int64(1)].(int64)
+	algorithm, _ := key[int64(3)].(int64)
+
+	switch {
+	case keyType == 2 && algorithm == ALG_ES256:
+		curve, _ := key[int64(-1)].(int64)
+		x, xOK := key[int64(-2)].([]byte)
+		y, yOK := key[int64(-3)].([]byte)
+
+		if curve != 1 || !xOK || !yOK {
+			return 0, nil, fmt.Errorf("unsupported EC2 key")
+		}
+
+		publicKey := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return 0, nil, fmt.Errorf("EC2 key isn't on the curve")
+		}
+
+		return algorithm, publicKey, nil
+	case keyType == 3 && algorithm == ALG_RS256:
+		n, nOK := key[int64(-1)].([]byte)
+		e, eOK := key[int64(-2)].([]byte)
+
+		if !nOK || !eOK {
+			return 0, nil, fmt.Errorf("unsupported RSA key")
+		}
+
+		return algorithm, &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	}
+
+	return 0, nil, fmt.Errorf("unsupported key type %d with algorithm %d", keyType, algorithm)
+}
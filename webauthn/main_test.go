@@ -0,0 +1,214 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+const testOrigin = "https://classly.example.edu"
+
+var testParty = &RelyingParty{ID: "classly.example.edu", Origins: []string{testOrigin}}
+
+// Acts like a platform authenticator holding one ES256 credential
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return &softAuthenticator{key: key, credentialID: id}
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	// {1: 2, 3: -7, -1: 1, -2: x, -3: y}
+	cose := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20}
+	cose = append(cose, a.key.X.FillBytes(make([]byte, 32))...)
+	cose = append(cose, 0x22, 0x58, 0x20)
+	return append(cose, a.key.Y.FillBytes(make([]byte, 32))...)
+}
+
+func (a *softAuthenticator) authenticatorData(rpID string, flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+func clientData(ceremony string, challenge []byte, origin string) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": Encoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+
+	return data
+}
+
+// What navigator.credentials.create() hands back, with "none" attestation
+func (a *softAuthenticator) create(challenge []byte) ([]byte, []byte) {
+	authData := a.authenticatorData(testParty.ID, flagUserPresent|flagAttestedData, true)
+
+	// {"fmt": "none", "attStmt": {}, "authData": authData}
+	attestation := []byte{0xa3, 0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e', 0x67, 'a', 't', 't', 'S', 't', 'm', 't', 0xa0, 0x68, 'a', 'u', 't', 'h', 'D', 'a', 't', 'a', 0x59}
+	attestation = binary.BigEndian.AppendUint16(attestation, uint16(len(authData)))
+	attestation = append(attestation, authData...)
+
+	return clientData("webauthn.create", challenge, testOrigin), attestation
+}
+
+// What navigator.credentials.get() hands back, counting up like a real authenticator
+func (a *softAuthenticator) get(t *testing.T, challenge []byte, flags byte) ([]byte, []byte, []byte) {
+	t.Helper()
+
+	a.signCount++
+
+	clientDataJSON := clientData("webauthn.get", challenge, testOrigin)
+	authData := a.authenticatorData(testParty.ID, flags, false)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	hash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clientDataJSON, authData, signature
+}
+
+func register(t *testing.T, a *softAuthenticator) *Credential {
+	t.Helper()
+
+	challenge := NewChallenge()
+	clientDataJSON, attestation := a.create(challenge)
+
+	credential, err := testParty.VerifyRegistration(challenge, clientDataJSON, attestation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return credential
+}
+
+func TestRegisterAndLogIn(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	credential := register(t, a)
+
+	if string(credential.ID) != string(a.credentialID) {
+		t.Fatalf("registered credential id %x, want %x", credential.ID, a.credentialID)
+	}
+
+	for i := 0; i < 2; i++ {
+		challenge := NewChallenge()
+		clientDataJSON, authData, signature := a.get(t, challenge, flagUserPresent)
+
+		signCount, err := testParty.VerifyAssertion(challenge, credential, clientDataJSON, authData, signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if signCount != a.signCount {
+			t.Fatalf("got sign count %d, want %d", signCount, a.signCount)
+		}
+
+		credential.SignCount = signCount
+	}
+}
+
+func TestRegistrationChecksClientData(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	challenge := NewChallenge()
+	_, attestation := a.create(challenge)
+
+	tests := map[string][]byte{
+		"other challenge": clientData("webauthn.create", NewChallenge(), testOrigin),
+		"other origin":    clientData("webauthn.create", challenge, "https://evil.example.com"),
+		"login data":      clientData("webauthn.get", challenge, testOrigin),
+	}
+
+	for name, clientDataJSON := range tests {
+		if _, err := testParty.VerifyRegistration(challenge, clientDataJSON, attestation); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestAssertionRejections(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	credential := register(t, a)
+
+	t.Run("wrong challenge", func(t *testing.T) {
+		clientDataJSON, authData, signature := a.get(t, NewChallenge(), flagUserPresent)
+
+		if _, err := testParty.VerifyAssertion(NewChallenge(), credential, clientDataJSON, authData, signature); err == nil {
+			t.Fatal("accepted")
+		}
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		challenge := NewChallenge()
+		clientDataJSON, authData, signature := a.get(t, challenge, flagUserPresent)
+		signature[len(signature)-1] ^= 0xff
+
+		if _, err := testParty.VerifyAssertion(challenge, credential, clientDataJSON, authData, signature); err == nil {
+			t.Fatal("accepted")
+		}
+	})
+
+	t.Run("other relying party", func(t *testing.T) {
+		other := &RelyingParty{ID: "evil.example.com", Origins: []string{testOrigin}}
+		challenge := NewChallenge()
+		clientDataJSON, authData, signature := a.get(t, challenge, flagUserPresent)
+
+		if _, err := other.VerifyAssertion(challenge, credential, clientDataJSON, authData, signature); err == nil {
+			t.Fatal("accepted")
+		}
+	})
+
+	t.Run("user not present", func(t *testing.T) {
+		challenge := NewChallenge()
+		clientDataJSON, authData, signature := a.get(t, challenge, 0)
+
+		if _, err := testParty.VerifyAssertion(challenge, credential, clientDataJSON, authData, signature); err == nil {
+			t.Fatal("accepted")
+		}
+	})
+
+	t.Run("sign count went backwards", func(t *testing.T) {
+		cloned := *credential
+		cloned.SignCount = a.signCount + 10
+
+		challenge := NewChallenge()
+		clientDataJSON, authData, signature := a.get(t, challenge, flagUserPresent)
+
+		if _, err := testParty.VerifyAssertion(challenge, &cloned, clientDataJSON, authData, signature); err == nil {
+			t.Fatal("accepted")
+		}
+	})
+}
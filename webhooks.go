@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/util"
+	"hacknhbackend.eparker.dev/webhooks"
+)
+
+const MAX_WEBHOOKS_PER_USER = 10
+
+// The secret is only ever shown when the hook is created
+func webhookJSON(hook *database.Webhook, withSecret bool) map[string]interface{} {
+	obj := map[string]interface{}{
+		"id":      hook.ID,
+		"url":     hook.URL,
+		"events":  hook.Events,
+		"global":  hook.Global,
+		"created": hook.CreatedAt.Unix(),
+	}
+
+	if withSecret {
+		obj["secret"] = hook.Secret
+	}
+
+	return obj
+}
+
+func deliveryJSON(delivery *database.WebhookDelivery) map[string]interface{} {
+	var next, finished interface{}
+
+	if delivery.NextAttemptAt != nil && delivery.Status == database.DELIVERY_PENDING {
+		next = delivery.NextAttemptAt.Unix()
+	}
+
+	if delivery.FinishedAt != nil {
+		finished = delivery.FinishedAt.Unix()
+	}
+
+	return map[string]interface{}{
+		"id":           delivery.ID,
+		"event":        delivery.Event,
+		"status":       delivery.Status,
+		"attempts":     delivery.Attempts,
+		"responseCode": delivery.ResponseCode,
+		"error":        delivery.Error,
+		"created":      delivery.CreatedAt.Unix(),
+		"nextAttempt":  next,
+		"finished":     finished,
+	}
+}
+
+// Owners can manage their own hooks, admins every global one
+func canManageWebhook(user *database.User, hook *database.Webhook) bool {
+	return hook.OwnerID == user.ID || (hook.Global && user.Can(database.PERMISSION_MANAGE_WEBHOOKS))
+}
+
+// Reads {"url": ..., "events": [...]} and registers the hook for the logged in user
+func createWebhook(w http.ResponseWriter, r *http.Request, global bool) {
+	obj := struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}{}
+
+	if !readJSON(w, r, &obj) {
+		return
+	}
+
+	url := strings.TrimSpace(obj.URL)
+
+	if !webhooks.ValidURL(url) || len(obj.Events) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, event := range obj.Events {
+		if !webhooks.ValidEvent(event) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	email, _ := r.Cookie("email")
+	user, err := database.GetUser(email.Value)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	existing, err := database.UserWebhooks(user.ID, false)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(existing) >= MAX_WEBHOOKS_PER_USER {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	hook, err := database.CreateWebhook(user.ID, url, obj.Events, global)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, webhookJSON(hook, true))
+
+	if global {
+		util.Log.Important(fmt.Sprintf("%s added global webhook %d for %s", user.Email, hook.ID, strings.Join(hook.Events, ", ")))
+	} else {
+		util.Log.Basic(fmt.Sprintf("User %s added webhook %d", user.Email, hook.ID))
+	}
+}
+
+// The logged in user and the hook named by id, as long as they can manage it
+func webhookRequest(w http.ResponseWriter, r *http.Request, id int) (*database.User, *database.Webhook, bool) {
+	email, _ := r.Cookie("email")
+	user, err := database.GetUser(email.Value)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	hook, err := database.GetWebhook(id)
+
+	if err != nil {
+		writeLookupError(w, err)
+		return nil, nil, false
+	}
+
+	if !canManageWebhook(user, hook) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	return user, hook, true
+}
+
+func registerWebhookRoutes() {
+	// Hooks only hear about courses their owner is in, see /admin/webhook/create for everything
+	http.HandleFunc("/user/webhook/create", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		createWebhook(w, r, false)
+	})
+
+	http.HandleFunc("/admin/webhook/create", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withPermission(w, r, database.PERMISSION_MANAGE_WEBHOOKS) {
+			return
+		}
+
+		createWebhook(w, r, true)
+	})
+
+	// The user's hooks, and for admins every global one too
+	http.HandleFunc("/user/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		email, _ := r.Cookie("email")
+		user, err := database.GetUser(email.Value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		hooks, err := database.UserWebhooks(user.ID, user.Can(database.PERMISSION_MANAGE_WEBHOOKS))
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		list := make([]map[string]interface{}, 0, len(hooks))
+
+		for i := range hooks {
+			list = append(list, webhookJSON(&hooks[i], false))
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"webhooks": list,
+			"events":   webhooks.EventTypes,
+		})
+	})
+
+	http.HandleFunc("/user/webhook/delete", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			ID int `json:"id"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		user, hook, ok := webhookRequest(w, r, obj.ID)
+
+		if !ok {
+			return
+		}
+
+		if err := database.DeleteWebhook(hook.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		util.Log.Basic(fmt.Sprintf("User %s deleted webhook %d", user.Email, hook.ID))
+	})
+
+	// The delivery log, newest first
+	http.HandleFunc("/user/webhook/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		withCors(w, r)
+
+		if !withVerified(w, r) {
+			return
+		}
+
+		obj := struct {
+			ID       int `json:"id"`
+			Page     int `json:"page"`
+			PageSize int `json:"pageSize"`
+		}{}
+
+		if !readJSON(w, r, &obj) {
+			return
+		}
+
+		_, hook, ok := webhookRequest(w, r, obj.ID)
+
+		if !ok {
+			return
+		}
+
+		page, pageSize, limit, offset := pagination(obj.Page, obj.PageSize)
+		deliveries, total, err := database.WebhookDeliveries(hook.ID, limit, offset)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		list := make([]map[string]interface{}, 0, len(deliveries))
+
+		for i := range deliveries {
+			list = append(list, deliveryJSON(&deliveries[i]))
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"deliveries": list,
+			"page":       page,
+			"pageSize":   pageSize,
+			"total":      total,
+		})
+	})
+}
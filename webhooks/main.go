@@ -0,0 +1,375 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/events"
+	"hacknhbackend.eparker.dev/util"
+)
+
+/**
+ * Outbound webhooks. Broadcast events are handed off through a
+ * buffer, so whoever broadcast them never waits on the database,
+ * then turned into one queued delivery per interested hook, and a
+ * worker posts them:
+ *  - signed with the hook's secret, see Sign
+ *  - retried with exponential backoff until WEBHOOKS_MAX_ATTEMPTS
+ *  - every attempt recorded in the hook's delivery log
+ * Deliveries live in the database, so retries survive restarts
+ */
+
+var EventTypes = []string{events.COURSE_CHANGED, events.COURSE_JOINED, events.SYNC_COMPLETED}
+
+const (
+	FIRST_RETRY = 30 * time.Second
+	MAX_RETRY   = time.Hour
+
+	POLL_INTERVAL = 5 * time.Second
+	BATCH_SIZE    = 20
+
+	// Broadcasts waiting to be turned into deliveries, past this they're dropped
+	DISPATCH_BUFFER = 256
+)
+
+var client *http.Client
+var wake chan struct{} = make(chan struct{}, 1)
+var incoming chan events.Event = make(chan events.Event, DISPATCH_BUFFER)
+
+// Ranges that aren't anywhere on the internet but aren't covered by net.IP's checks either
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8",     // "this network"
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved, and the broadcast address
+	"64:ff9b::/96",  // NAT64, can reach anything IPv4 behind it
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+func Init() {
+	client = newClient()
+
+	events.Listen(enqueue)
+
+	go dispatcher()
+	go worker()
+}
+
+func newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: util.Config.Webhooks.Timeout, Control: checkAddress}
+
+	return &http.Client{
+		Timeout:   util.Config.Webhooks.Timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+
+		// A redirect is a failed delivery, not somewhere else to send it
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Runs in the broadcaster's goroutine, so it only ever hands the event off
+func enqueue(event events.Event) {
+	if !ValidEvent(event.Type) {
+		return
+	}
+
+	select {
+	case incoming <- event:
+	default:
+		util.Log.Error(fmt.Sprintf("Dropped %s for webhooks, too many events waiting", event.Type))
+	}
+}
+
+func dispatcher() {
+	for event := range incoming {
+		dispatch(event)
+	}
+}
+
+// Checked on the address actually dialed, so hostnames that resolve somewhere internal are caught too
+func checkAddress(network, address string, conn syscall.RawConn) error {
+	if util.Config.Webhooks.AllowPrivate {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || blocked(ip) {
+		return fmt.Errorf("webhooks can't be sent to %s", host)
+	}
+
+	return nil
+}
+
+// Anything that isn't a public unicast address
+func blocked(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return true
+	}
+
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Plain http is only for local receivers, which need WEBHOOKS_ALLOW_PRIVATE anyway
+func ValidURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+
+	if err != nil || parsed.Host == "" || parsed.User != nil {
+		return false
+	}
+
+	return parsed.Scheme == "https" || (parsed.Scheme == "http" && util.Config.Webhooks.AllowPrivate)
+}
+
+func ValidEvent(event string) bool {
+	return slices.Contains(EventTypes, event)
+}
+
+// Hex HMAC-SHA256 of "<timestamp>.<body>", sent as X-Webhook-Signature: sha256=<signature>
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// How long to wait after the given number of failed attempts
+func backoff(attempts int) time.Duration {
+	delay := FIRST_RETRY
+
+	for i := 1; i < attempts && delay < MAX_RETRY; i++ {
+		delay *= 2
+	}
+
+	return min(delay, MAX_RETRY)
+}
+
+/**
+ * What the hook's owner gets to know about the event. Global hooks
+ * hear about every course, anyone else only about courses they're
+ * in, and only about classmates whose courses they could see anyway
+ */
+func payloadFor(hook *database.Webhook, owner *database.User, event events.Event) (interface{}, bool) {
+	fields := struct {
+		CRN  string `json:"crn"`
+		User int    `json:"user"`
+	}{}
+
+	json.Unmarshal(event.Data, &fields)
+
+	global := hook.Global && owner.Can(database.PERMISSION_MANAGE_WEBHOOKS)
+
+	switch event.Type {
+	case events.COURSE_CHANGED:
+		return event.Data, global || owner.EnrolledIn(fields.CRN)
+	case events.COURSE_JOINED:
+		if !global && !owner.EnrolledIn(fields.CRN) {
+			return nil, false
+		}
+
+		joined, err := database.GetUserByID(fields.User)
+
+		if err != nil || !joined.CanSee(owner, database.PRIVACY_FIELD_COURSES) {
+			return nil, false
+		}
+
+		return map[string]interface{}{"crn": fields.CRN, "user": joined.Profile(owner)}, true
+	case events.SYNC_COMPLETED:
+		return event.Data, true
+	}
+
+	return nil, false
+}
+
+func dispatch(event events.Event) {
+	if !ValidEvent(event.Type) {
+		return
+	}
+
+	hooks, err := database.AllWebhooks()
+
+	if err != nil {
+		util.Log.Error(fmt.Sprintf("Error loading webhooks for %s: %v", event.Type, err))
+		return
+	}
+
+	queued := 0
+
+	for i := range hooks {
+		if !hooks[i].Wants(event.Type) {
+			continue
+		}
+
+		owner, err := database.GetUserByID(hooks[i].OwnerID)
+
+		if err != nil {
+			continue
+		}
+
+		data, ok := payloadFor(&hooks[i], owner, event)
+
+		if !ok {
+			continue
+		}
+
+		body, err := json.Marshal(map[string]interface{}{
+			"event":   event.Type,
+			"created": event.Time.Unix(),
+			"data":    data,
+		})
+
+		if err != nil {
+			continue
+		}
+
+		if err := database.QueueDelivery(hooks[i].ID, event.Type, string(body)); err != nil {
+			util.Log.Error(fmt.Sprintf("Error queueing webhook %d: %v", hooks[i].ID, err))
+			continue
+		}
+
+		queued++
+	}
+
+	if queued > 0 {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func worker() {
+	ticker := time.NewTicker(POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-wake:
+		}
+
+	batches:
+		for {
+			due, err := database.DueDeliveries(BATCH_SIZE)
+
+			if err != nil {
+				util.Log.Error(fmt.Sprintf("Error loading webhook deliveries: %v", err))
+				break
+			}
+
+			// A delivery that couldn't be recorded is still due, carrying on would send it again straight away
+			for i := range due {
+				if err := deliver(&due[i]); err != nil {
+					util.Log.Error(fmt.Sprintf("Error recording webhook delivery %d: %v", due[i].ID, err))
+					break batches
+				}
+			}
+
+			if len(due) < BATCH_SIZE {
+				break
+			}
+		}
+	}
+}
+
+// Tries once, then either finishes the delivery or schedules the next attempt.
+// The error is only for failing to record how it went
+func deliver(delivery *database.WebhookDelivery) error {
+	hook, err := database.GetWebhook(delivery.WebhookID)
+
+	if err != nil {
+		return delivery.RecordAttempt(database.DELIVERY_FAILED, 0, "webhook no longer exists", nil)
+	}
+
+	code, err := post(hook, delivery)
+
+	if err == nil {
+		return delivery.RecordAttempt(database.DELIVERY_SUCCEEDED, code, "", nil)
+	}
+
+	if delivery.Attempts+1 >= util.Config.Webhooks.MaxAttempts {
+		util.Log.Error(fmt.Sprintf("Gave up on webhook delivery %d to %s: %v", delivery.ID, hook.URL, err))
+		return delivery.RecordAttempt(database.DELIVERY_FAILED, code, err.Error(), nil)
+	}
+
+	next := time.Now().Add(backoff(delivery.Attempts + 1))
+
+	return delivery.RecordAttempt(database.DELIVERY_PENDING, code, err.Error(), &next)
+}
+
+// The response code, and an error for anything but a 2xx
+func post(hook *database.Webhook, delivery *database.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	ctx, cancel := context.WithTimeout(context.Background(), util.Config.Webhooks.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Classly-Webhooks")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(hook.Secret, timestamp, body))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer res.Body.Close()
+
+	// Read a little so the connection can be reused, nobody looks at it
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver answered %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
@@ -0,0 +1,174 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"hacknhbackend.eparker.dev/database"
+	"hacknhbackend.eparker.dev/events"
+	"hacknhbackend.eparker.dev/util"
+)
+
+func TestBlockedAddresses(t *testing.T) {
+	tests := map[string]bool{
+		"8.8.8.8":            false,
+		"2606:4700::1111":    false,
+		"127.0.0.1":          true,
+		"10.1.2.3":           true,
+		"169.254.169.254":    true,
+		"0.0.0.0":            true,
+		"0.1.2.3":            true,
+		"100.64.0.1":         true,
+		"100.127.255.254":    true,
+		"198.18.0.1":         true,
+		"224.0.0.1":          true,
+		"255.255.255.255":    true,
+		"::1":                true,
+		"fd00::1":            true,
+		"ff02::1":            true,
+		"::ffff:192.168.0.1": true,
+		"64:ff9b::a00:1":     true,
+	}
+
+	for address, want := range tests {
+		if got := blocked(net.ParseIP(address)); got != want {
+			t.Errorf("%s: blocked = %v, want %v", address, got, want)
+		}
+	}
+}
+
+// A receiver that fails the first delivery, then accepts, remembering what it was sent
+type receiver struct {
+	lock     sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rec *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	rec.requests = append(rec.requests, r)
+	rec.bodies = append(rec.bodies, body)
+
+	if len(rec.requests) == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestDeliveryIsSignedRetriedAndLogged(t *testing.T) {
+	database.OpenTestDatabase(t)
+
+	util.Config.Webhooks.AllowPrivate = true
+	util.Config.Webhooks.MaxAttempts = 3
+	util.Config.Webhooks.Timeout = 5 * time.Second
+	client = newClient()
+
+	rec := &receiver{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	owner, status := database.CreateUser("owner@example.edu", "Hook", "Owner", "password1")
+	if status != database.CREATE_USER_SUCCESS {
+		t.Fatalf("creating the owner: status %d", status)
+	}
+
+	hook, err := database.CreateWebhook(owner.ID, server.URL, []string{events.SYNC_COMPLETED}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dispatch(events.Event{Type: events.SYNC_COMPLETED, Data: json.RawMessage(`{"courses":3}`), Time: time.Now()})
+
+	due, err := database.DueDeliveries(BATCH_SIZE)
+	if err != nil || len(due) != 1 {
+		t.Fatalf("got %d due deliveries (%v), want 1", len(due), err)
+	}
+
+	// The receiver fails the first try, the worker would pick it up again once it's due
+	if err := deliver(&due[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if due[0].Status != database.DELIVERY_PENDING || due[0].ResponseCode != http.StatusServiceUnavailable || due[0].NextAttemptAt == nil {
+		t.Fatalf("after a 503: status %s, code %d, next %v", due[0].Status, due[0].ResponseCode, due[0].NextAttemptAt)
+	}
+
+	if wait := time.Until(*due[0].NextAttemptAt); wait < FIRST_RETRY-time.Second || wait > FIRST_RETRY+time.Second {
+		t.Fatalf("retrying in %s, want %s", wait, FIRST_RETRY)
+	}
+
+	if err := deliver(&due[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.requests) != 2 {
+		t.Fatalf("receiver got %d requests, want 2", len(rec.requests))
+	}
+
+	for i, r := range rec.requests {
+		timestamp, err := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+Sign(hook.Secret, timestamp, rec.bodies[i]) {
+			t.Errorf("request %d has a bad signature", i)
+		}
+
+		if r.Header.Get("X-Webhook-Event") != events.SYNC_COMPLETED || r.Header.Get("X-Webhook-Delivery") != strconv.Itoa(due[0].ID) {
+			t.Errorf("request %d headers: %v", i, r.Header)
+		}
+	}
+
+	payload := struct {
+		Event string         `json:"event"`
+		Data  map[string]int `json:"data"`
+	}{}
+
+	if err := json.Unmarshal(rec.bodies[1], &payload); err != nil || payload.Event != events.SYNC_COMPLETED || payload.Data["courses"] != 3 {
+		t.Fatalf("unexpected payload %s (%v)", rec.bodies[1], err)
+	}
+
+	log, total, err := database.WebhookDeliveries(hook.ID, 10, 0)
+	if err != nil || total != 1 {
+		t.Fatalf("got %d logged deliveries (%v), want 1", total, err)
+	}
+
+	if log[0].Status != database.DELIVERY_SUCCEEDED || log[0].Attempts != 2 || log[0].ResponseCode != http.StatusNoContent || log[0].FinishedAt == nil {
+		t.Fatalf("logged as %s after %d attempts with %d", log[0].Status, log[0].Attempts, log[0].ResponseCode)
+	}
+
+	if due, _ := database.DueDeliveries(BATCH_SIZE); len(due) != 0 {
+		t.Fatalf("%d deliveries still due", len(due))
+	}
+}
+
+func TestPrivateReceiversAreRefused(t *testing.T) {
+	util.Config.Webhooks.AllowPrivate = false
+	util.Config.Webhooks.Timeout = 5 * time.Second
+	client = newClient()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("delivered to a loopback receiver")
+	}))
+	defer server.Close()
+
+	_, err := post(&database.Webhook{URL: server.URL, Secret: "secret"}, &database.WebhookDelivery{ID: 1, Event: events.SYNC_COMPLETED, Payload: "{}"})
+
+	if err == nil {
+		t.Fatal("posted to a loopback receiver")
+	}
+}
@@ -0,0 +1,332 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/**
+ * Server side of RFC 6455, enough for a browser chat:
+ * text and binary messages, fragmentation, ping/pong
+ * and the closing handshake. No extensions, so no
+ * compression
+ */
+
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// Close codes from section 7.4.1
+const (
+	CloseNormal       = 1000
+	CloseGoingAway    = 1001
+	CloseProtocol     = 1002
+	CloseUnsupported  = 1003
+	CloseInvalidData  = 1007
+	CloseTooBig       = 1009
+	ClosePolicy       = 1008
+	closeNoStatusSent = 1005
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrorClosed error = fmt.Errorf("websocket: connection closed")
+
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Messages bigger than this close the connection
+	MaxMessageSize int64
+
+	// How long to wait for each frame, pongs count. Zero waits forever
+	ReadTimeout time.Duration
+
+	writeLock sync.Mutex
+	closed    bool
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Takes over the connection after the handshake. On failure the response has already been written
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("websocket: method %s", r.Method)
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: not an upgrade request")
+	}
+
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: bad key")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("websocket: unsupported version")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, fmt.Errorf("websocket: connection can't be hijacked")
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything buffered past the request belongs to the websocket
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetWriteDeadline(time.Time{})
+
+	return &Conn{
+		conn:           conn,
+		reader:         buffered.Reader,
+		MaxMessageSize: 64 << 10,
+	}, nil
+}
+
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+func (c *Conn) readFrame() (*frame, error) {
+	if c.ReadTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	}
+
+	var header [2]byte
+
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	f := &frame{
+		fin:    header[0]&0x80 != 0,
+		opcode: header[0] & 0x0f,
+	}
+
+	if header[0]&0x70 != 0 {
+		return nil, c.fail(CloseProtocol, "reserved bits set")
+	}
+
+	// Clients always mask
+	if header[1]&0x80 == 0 {
+		return nil, c.fail(CloseProtocol, "unmasked frame")
+	}
+
+	length := int64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return nil, err
+		}
+
+		length = int64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return nil, err
+		}
+
+		length = int64(binary.BigEndian.Uint64(extended[:]) & (1<<63 - 1))
+	}
+
+	if f.opcode >= CloseMessage && (length > 125 || !f.fin) {
+		return nil, c.fail(CloseProtocol, "bad control frame")
+	}
+
+	if length > c.MaxMessageSize {
+		return nil, c.fail(CloseTooBig, "message too big")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return nil, err
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return nil, err
+	}
+
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+
+	return f, nil
+}
+
+// Returns the next text or binary message, answering pings and closes along the way
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var opcode int
+	var message []byte
+
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case PingMessage:
+			if err := c.WriteMessage(PongMessage, f.payload); err != nil {
+				return 0, nil, err
+			}
+
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			code := closeNoStatusSent
+
+			if len(f.payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(f.payload))
+			}
+
+			c.Close(code, "")
+
+			return 0, nil, ErrorClosed
+		case TextMessage, BinaryMessage:
+			if message != nil {
+				return 0, nil, c.fail(CloseProtocol, "new message before the last one finished")
+			}
+
+			opcode = int(f.opcode)
+			message = f.payload
+		case 0:
+			if message == nil {
+				return 0, nil, c.fail(CloseProtocol, "continuation without a message")
+			}
+
+			if int64(len(message)+len(f.payload)) > c.MaxMessageSize {
+				return 0, nil, c.fail(CloseTooBig, "message too big")
+			}
+
+			message = append(message, f.payload...)
+		default:
+			return 0, nil, c.fail(CloseProtocol, "unknown opcode")
+		}
+
+		if f.fin {
+			if opcode == TextMessage && !utf8.Valid(message) {
+				return 0, nil, c.fail(CloseInvalidData, "text isn't utf-8")
+			}
+
+			return opcode, message, nil
+		}
+	}
+}
+
+// Sends a whole message as one frame, safe to call from several goroutines
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.closed {
+		return ErrorClosed
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | byte(opcode)
+
+	switch length := len(data); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := c.conn.Write(append(header, data...)); err != nil {
+		c.closed = true
+		c.conn.Close()
+		return err
+	}
+
+	if opcode == CloseMessage {
+		c.closed = true
+		c.conn.Close()
+	}
+
+	return nil
+}
+
+// Sends a close frame and shuts the connection, safe to call more than once
+func (c *Conn) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+
+	if code == closeNoStatusSent {
+		payload = nil
+	}
+
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+
+	if err := c.WriteMessage(CloseMessage, append(payload, reason...)); err != nil && err != ErrorClosed {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Conn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return fmt.Errorf("websocket: %s", reason)
+}